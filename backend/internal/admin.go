@@ -0,0 +1,191 @@
+package internal
+
+import (
+	"context"
+	"rinha-backend-arthur/internal/models"
+	"rinha-backend-arthur/internal/queue"
+	"strconv"
+
+	"github.com/valyala/fasthttp"
+)
+
+const defaultDeadLetterPageSize = 100
+
+func (h *Handler) HandleMetrics(ctx *fasthttp.RequestCtx) {
+	queueMetrics, err := h.paymentProcessor.Queue.Depth(context.Background())
+	if err != nil {
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		ctx.SetBodyString("Failed to retrieve queue metrics")
+		return
+	}
+
+	processorErrors, err := h.paymentProcessor.Store.GetProcessorErrors(context.Background())
+	if err != nil {
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		ctx.SetBodyString("Failed to retrieve processor error counts")
+		return
+	}
+
+	sendJSONResponse(ctx, models.MetricsResponse{
+		Queue:           queueMetrics,
+		ProcessorErrors: processorErrors,
+		OutboxBacklog:   h.paymentProcessor.Outbox.Backlog(),
+	})
+}
+
+func (h *Handler) HandleQueueMetrics(ctx *fasthttp.RequestCtx) {
+	metrics, err := h.paymentProcessor.Queue.Depth(context.Background())
+	if err != nil {
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		ctx.SetBodyString("Failed to retrieve queue metrics")
+		return
+	}
+
+	sendJSONResponse(ctx, metrics)
+}
+
+// deadLetters answers 501 Not Implemented when the queue keeps no dead letters.
+func (h *Handler) deadLetters(ctx *fasthttp.RequestCtx) (queue.DeadLetterQueue, bool) {
+	deadLetters, ok := h.paymentProcessor.Queue.(queue.DeadLetterQueue)
+	if !ok {
+		sendJSONError(ctx, fasthttp.StatusNotImplemented, models.ErrorResponse{Error: "queue has no dead-letter queue"})
+	}
+	return deadLetters, ok
+}
+
+func (h *Handler) HandleListDeadLetters(ctx *fasthttp.RequestCtx) {
+	deadLetters, ok := h.deadLetters(ctx)
+	if !ok {
+		return
+	}
+
+	offset, err := parseNonNegativeInt(ctx.QueryArgs().Peek("offset"), 0)
+	if err != nil {
+		sendJSONError(ctx, fasthttp.StatusBadRequest, models.ErrorResponse{
+			Error:  "invalid query parameters",
+			Fields: []models.FieldError{{Field: "offset", Message: "must be a non-negative integer"}},
+		})
+		return
+	}
+
+	limit, err := parseNonNegativeInt(ctx.QueryArgs().Peek("limit"), defaultDeadLetterPageSize)
+	if err != nil || limit == 0 {
+		sendJSONError(ctx, fasthttp.StatusBadRequest, models.ErrorResponse{
+			Error:  "invalid query parameters",
+			Fields: []models.FieldError{{Field: "limit", Message: "must be a positive integer"}},
+		})
+		return
+	}
+
+	response, err := deadLetters.ListDeadLetters(context.Background(), offset, limit)
+	if err != nil {
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		ctx.SetBodyString("Failed to list dead letters")
+		return
+	}
+
+	sendJSONResponse(ctx, response)
+}
+
+func (h *Handler) HandleGetDeadLetter(ctx *fasthttp.RequestCtx) {
+	deadLetters, ok := h.deadLetters(ctx)
+	if !ok {
+		return
+	}
+	correlationId, ok := correlationIdFromPath(ctx)
+	if !ok {
+		return
+	}
+
+	msg, err := deadLetters.GetDeadLetter(context.Background(), correlationId)
+	if err != nil {
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		ctx.SetBodyString("Failed to retrieve dead letter")
+		return
+	}
+	if msg == nil {
+		sendJSONError(ctx, fasthttp.StatusNotFound, models.ErrorResponse{Error: "dead letter not found"})
+		return
+	}
+
+	sendJSONResponse(ctx, msg)
+}
+
+func (h *Handler) HandleReplayDeadLetter(ctx *fasthttp.RequestCtx) {
+	deadLetters, ok := h.deadLetters(ctx)
+	if !ok {
+		return
+	}
+	correlationId, ok := correlationIdFromPath(ctx)
+	if !ok {
+		return
+	}
+
+	replayed, err := deadLetters.ReplayDeadLetter(context.Background(), correlationId)
+	if err != nil {
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		ctx.SetBodyString("Failed to replay dead letter")
+		return
+	}
+	if !replayed {
+		sendJSONError(ctx, fasthttp.StatusNotFound, models.ErrorResponse{Error: "dead letter not found"})
+		return
+	}
+
+	h.paymentProcessor.Store.RecordPaymentTransition(context.Background(), correlationId, models.PaymentTransition{
+		Status: models.PaymentStatusQueued,
+	})
+
+	ctx.SetStatusCode(fasthttp.StatusAccepted)
+}
+
+func (h *Handler) HandleDiscardDeadLetter(ctx *fasthttp.RequestCtx) {
+	deadLetters, ok := h.deadLetters(ctx)
+	if !ok {
+		return
+	}
+	correlationId, ok := correlationIdFromPath(ctx)
+	if !ok {
+		return
+	}
+
+	msg, err := deadLetters.GetDeadLetter(context.Background(), correlationId)
+	if err != nil {
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		ctx.SetBodyString("Failed to discard dead letter")
+		return
+	}
+	if msg == nil {
+		sendJSONError(ctx, fasthttp.StatusNotFound, models.ErrorResponse{Error: "dead letter not found"})
+		return
+	}
+
+	// Forget the correlationId so the payment can be submitted again, together with the dead letter when both are in Redis
+	discarded, err := h.paymentProcessor.Store.DiscardPayment(context.Background(), correlationId)
+	if err == nil && !discarded {
+		discarded, err = deadLetters.DiscardDeadLetter(context.Background(), correlationId)
+	}
+	if err != nil {
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		ctx.SetBodyString("Failed to discard dead letter")
+		return
+	}
+	if !discarded {
+		sendJSONError(ctx, fasthttp.StatusNotFound, models.ErrorResponse{Error: "dead letter not found"})
+		return
+	}
+
+	ctx.SetStatusCode(fasthttp.StatusNoContent)
+}
+
+func parseNonNegativeInt(value []byte, defaultValue int64) (int64, error) {
+	if len(value) == 0 {
+		return defaultValue, nil
+	}
+
+	parsed, err := strconv.ParseInt(string(value), 10, 64)
+	if err != nil || parsed < 0 {
+		return 0, strconv.ErrSyntax
+	}
+	return parsed, nil
+}
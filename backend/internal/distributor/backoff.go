@@ -0,0 +1,29 @@
+package distributor
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+type BackoffConfig struct {
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	Jitter    float64 // fraction of the delay added at random, 0.2 means up to +20%
+}
+
+// Delay returns how long to wait before the given attempt (1-based) is retried.
+func (b BackoffConfig) Delay(attempt int) time.Duration {
+	delay := b.BaseDelay
+	for i := 1; i < attempt && delay < b.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > b.MaxDelay {
+		delay = b.MaxDelay
+	}
+
+	if b.Jitter > 0 && delay > 0 {
+		delay += time.Duration(rand.Float64() * b.Jitter * float64(delay))
+	}
+
+	return delay
+}
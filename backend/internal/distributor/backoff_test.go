@@ -0,0 +1,55 @@
+package distributor
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	b := BackoffConfig{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{0, 100 * time.Millisecond},
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{3, 400 * time.Millisecond},
+		{4, 800 * time.Millisecond},
+		{5, time.Second}, // capped
+		{6, time.Second},
+		{1000, time.Second}, // doesn't overflow
+	}
+
+	for _, tt := range tests {
+		if got := b.Delay(tt.attempt); got != tt.want {
+			t.Errorf("Delay(%d) = %v, want %v", tt.attempt, got, tt.want)
+		}
+	}
+}
+
+func TestBackoffJitterBounds(t *testing.T) {
+	b := BackoffConfig{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second, Jitter: 0.2}
+
+	for _, attempt := range []int{1, 3, 10} {
+		base := BackoffConfig{BaseDelay: b.BaseDelay, MaxDelay: b.MaxDelay}.Delay(attempt)
+		upper := base + time.Duration(b.Jitter*float64(base))
+
+		var varied bool
+		for range 200 {
+			got := b.Delay(attempt)
+			if got < base || got > upper {
+				t.Fatalf("Delay(%d) = %v, want within [%v, %v]", attempt, got, base, upper)
+			}
+			varied = varied || got != base
+		}
+		if !varied {
+			t.Errorf("Delay(%d) never added jitter", attempt)
+		}
+	}
+
+	if got := (BackoffConfig{Jitter: 0.5}).Delay(3); got != 0 {
+		t.Errorf("Delay without a base delay = %v, want 0", got)
+	}
+}
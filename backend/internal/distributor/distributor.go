@@ -4,27 +4,60 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"rinha-backend-arthur/internal/health"
 	"rinha-backend-arthur/internal/models"
+	"rinha-backend-arthur/internal/outbox"
+	"rinha-backend-arthur/internal/queue"
 	"rinha-backend-arthur/internal/store"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
-	"github.com/redis/go-redis/v9"
 )
 
+const promoteRetriesBatchSize = 100
+
+type Config struct {
+	Workers           int
+	MaxAttempts       int
+	Backoff           BackoffConfig
+	RetryPollInterval time.Duration
+	VisibilityTimeout time.Duration
+	ReaperInterval    time.Duration
+	BatchSize         int
+	BlockTimeout      time.Duration
+	OutboxInterval    time.Duration
+}
+
 type PaymentProcessor struct {
-	Store   *store.Store
-	workers int
-	client  *http.Client
-	health  *health.HealthCheckService
+	Store             store.Store
+	Queue             queue.Queue
+	Outbox            *outbox.Outbox
+	deadLetters       queue.DeadLetterQueue // nil when the queue has no dead-letter queue
+	retries           queue.RetryQueue      // nil when the queue brings nothing back on its own
+	workers           int
+	maxAttempts       int
+	backoff           BackoffConfig
+	retryPollInterval time.Duration
+	visibilityTimeout time.Duration
+	reaperInterval    time.Duration
+	batchSize         int
+	blockTimeout      time.Duration
+	outboxInterval    time.Duration
+	client            *http.Client
+	health            *health.HealthCheckService
+	wg                sync.WaitGroup // workers and background loops
 }
 
-func NewPaymentProcessor(workers int, store *store.Store, healthCheckService *health.HealthCheckService) *PaymentProcessor {
+// NewPaymentProcessor starts the workers and background loops, they stop when ctx is cancelled.
+// Wait blocks until they did.
+func NewPaymentProcessor(ctx context.Context, config Config, store store.Store, paymentQueue queue.Queue, paymentOutbox *outbox.Outbox, healthCheckService *health.HealthCheckService) *PaymentProcessor {
+	// Timeouts are per processor, see sendPayment
 	httpClient := &http.Client{
-		Timeout: 5 * time.Second,
 		Transport: &http.Transport{
 			MaxIdleConns:        10,
 			MaxIdleConnsPerHost: 5,
@@ -33,105 +66,323 @@ func NewPaymentProcessor(workers int, store *store.Store, healthCheckService *he
 		},
 	}
 
+	deadLetters, _ := paymentQueue.(queue.DeadLetterQueue)
+	retries, _ := paymentQueue.(queue.RetryQueue)
+
 	processor := &PaymentProcessor{
-		workers: workers,
-		Store:   store,
-		client:  httpClient,
-		health:  healthCheckService,
+		workers:           config.Workers,
+		maxAttempts:       config.MaxAttempts,
+		backoff:           config.Backoff,
+		retryPollInterval: config.RetryPollInterval,
+		visibilityTimeout: config.VisibilityTimeout,
+		reaperInterval:    config.ReaperInterval,
+		batchSize:         config.BatchSize,
+		blockTimeout:      config.BlockTimeout,
+		outboxInterval:    config.OutboxInterval,
+		Store:             store,
+		Queue:             paymentQueue,
+		Outbox:            paymentOutbox,
+		deadLetters:       deadLetters,
+		retries:           retries,
+		client:            httpClient,
+		health:            healthCheckService,
 	}
 
 	// Start health check with ticker
-	go processor.health.StartHealthCheckLoop()
+	processor.run(func() { processor.health.StartHealthCheckLoop(ctx) })
+
+	if retries != nil {
+		processor.run(func() { processor.promoteDueRetries(ctx) })
 
-	for i := range workers {
-		go processor.distributePayment(i)
+		processor.run(func() { processor.reapOrphanedPayments(ctx) })
+	}
+
+	processor.run(func() { processor.flushOutbox(ctx) })
+
+	for i := range config.Workers {
+		processor.run(func() { processor.distributePayment(ctx, i) })
 	}
 
 	return processor
 }
 
-func (p *PaymentProcessor) distributePayment(workerNum int) {
+func (p *PaymentProcessor) run(loop func()) {
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		loop()
+	}()
+}
+
+// Wait blocks until the workers finished their claimed deliveries and the background loops stopped.
+func (p *PaymentProcessor) Wait() {
+	p.wg.Wait()
+}
 
-	ctx := context.Background()
-	processingQueue := fmt.Sprintf("payments:processing:%d", workerNum)
-	for {
-		result, err := p.Store.RedisClient.RPopLPush(ctx, "payments:queue", processingQueue).Result()
+func (p *PaymentProcessor) distributePayment(ctx context.Context, workerNum int) {
+	for ctx.Err() == nil {
+		deliveries, err := p.Queue.Dequeue(ctx, workerNum, p.batchSize, p.blockTimeout)
 		if err != nil {
-			if err == redis.Nil {
-				time.Sleep(100 * time.Millisecond) // No items to process, wait a bit
-				continue
+			if ctx.Err() != nil {
+				return
 			}
+			fmt.Printf("[Worker %v] Failed to claim payments: %v\n", workerNum, err)
+			time.Sleep(100 * time.Millisecond) // Redis is unavailable, wait a bit
+			continue
 		}
 
-		var incoming struct {
-			CorrelationId uuid.UUID `json:"correlationId"`
-			Amount        float64   `json:"amount"`
+		// Claimed deliveries are finished even during shutdown, the reaper would only requeue them later
+		processCtx := context.WithoutCancel(ctx)
+		for _, delivery := range deliveries {
+			p.processDelivery(processCtx, workerNum, delivery)
 		}
+	}
+}
 
-		if err := json.Unmarshal([]byte(result), &incoming); err != nil {
-			fmt.Printf("[Worker %v] Failed to unmarshal payment: %v\n", workerNum, err)
-			p.Store.RedisClient.LRem(ctx, processingQueue, 1, result) // Remove from processing queue
-			continue
+func (p *PaymentProcessor) processDelivery(ctx context.Context, workerNum int, delivery queue.Delivery) {
+	var incoming struct {
+		CorrelationId uuid.UUID    `json:"correlationId"`
+		Amount        models.Money `json:"amount"`
+	}
+
+	if err := json.Unmarshal(delivery.Message.Payload, &incoming); err != nil {
+		fmt.Printf("[Worker %v] Failed to unmarshal payment: %v\n", workerNum, err)
+		p.Queue.Ack(ctx, delivery) // Remove from processing queue
+		return
+	}
+
+	settled, err := p.Store.IsPaymentSettled(ctx, incoming.CorrelationId)
+	if err != nil {
+		// Sending it now could charge a payment settled already, wait for the store to be back
+		fmt.Printf("[Worker %v] Failed to check whether payment %v is settled: %v\n", workerNum, incoming.CorrelationId, err)
+		retryAt := time.Now().UTC().Add(p.backoff.Delay(delivery.Message.Attempts + 1))
+		if err := p.Queue.Nack(ctx, delivery, retryAt); err != nil {
+			fmt.Printf("[Worker %v] Failed to schedule payment retry: %v\n", workerNum, err)
+		}
+		return
+	}
+	if settled {
+		// Already processed and stored, don't send it to the processor again
+		p.Queue.Ack(ctx, delivery)
+		return
+	}
+
+	// Deliveries that were never settled didn't come back through Nack, count them as attempts
+	// so a payment that keeps killing its worker still ends in the dead-letter queue
+	if delivery.DeliveryCount > 1 {
+		delivery.Message.Attempts += int(delivery.DeliveryCount - 1)
+	}
+	delivery.Message.Attempts++
+	p.Store.RecordPaymentTransition(ctx, incoming.CorrelationId, models.PaymentTransition{
+		Status:  models.PaymentStatusProcessing,
+		Worker:  &workerNum,
+		Attempt: delivery.Message.Attempts,
+	})
+
+	if service := delivery.Message.AmbiguousProcessor; service != "" {
+		if !p.resolvePreviousAttempt(ctx, workerNum, delivery, service) {
+			return
+		}
+		delivery.Message.AmbiguousProcessor = ""
+	}
+
+	payment := models.PaymentRequest{
+		CorrelationId: incoming.CorrelationId,
+		Amount:        incoming.Amount,
+		RequestedAt:   time.Now().UTC(),
+	}
+
+	service, err := p.ProcessPayments(payment)
+	if err != nil {
+		p.Store.IncrementProcessorErrors(ctx, string(classOf(err)))
+	}
+
+	var ambiguous *AmbiguousOutcomeError
+	var processorErr *ProcessorError
+	switch {
+	case errors.As(err, &ambiguous):
+		err = p.resolveAmbiguousOutcome(ctx, &delivery, ambiguous)
+	case errors.As(err, &processorErr) && processorErr.Class == ErrorClassAlreadyProcessed:
+		err = p.resolveAlreadyProcessed(ctx, &delivery, processorErr)
+	}
+
+	switch {
+	case err != nil:
+		fmt.Printf("[Worker %v] Failed to process payment: %v\n", workerNum, err)
+		p.handleFailedPayment(ctx, workerNum, delivery, err)
+	case service != "":
+		// Successfully processed - record it and remove it from the queue in one step.
+		// Outcomes found by the resolver were already settled there.
+		p.settle(ctx, delivery, payment, service)
+	}
+}
+
+// handleFailedPayment requeues the payment after its backoff, or moves it to the DLQ once it
+// ran out of attempts or failed with a terminal error.
+func (p *PaymentProcessor) handleFailedPayment(ctx context.Context, workerNum int, delivery queue.Delivery, err error) {
+	delivery.Message.LastError = err.Error()
+	msg := delivery.Message
+	class := classOf(err)
+
+	if msg.Attempts >= p.maxAttempts || class == ErrorClassTerminal {
+		if p.deadLetters == nil {
+			fmt.Printf("[Worker %v] Dropping payment %s, the queue has no dead-letter queue\n", workerNum, msg.CorrelationId)
+			p.Queue.Ack(ctx, delivery)
+		} else if err := p.deadLetters.DeadLetter(ctx, delivery); err != nil {
+			fmt.Printf("[Worker %v] Failed to dead-letter payment: %v\n", workerNum, err)
+			return
 		}
-		payment := models.PaymentRequest{
-			CorrelationId: incoming.CorrelationId,
-			Amount:        int64(incoming.Amount * 100), // Convert to cents
-			RequestedAt:   time.Now().UTC(),
+		p.Store.RecordPaymentTransition(ctx, msg.CorrelationId, models.PaymentTransition{
+			Status:  models.PaymentStatusDeadLettered,
+			Worker:  &workerNum,
+			Attempt: msg.Attempts,
+			Error:   msg.LastError,
+		})
+		return
+	}
+
+	delay := p.backoff.Delay(msg.Attempts)
+	var processorErr *ProcessorError
+	if errors.As(err, &processorErr) && processorErr.RetryAfter > delay {
+		delay = processorErr.RetryAfter
+	}
+
+	retryAt := time.Now().UTC().Add(delay)
+	if err := p.Queue.Nack(ctx, delivery, retryAt); err != nil {
+		fmt.Printf("[Worker %v] Failed to schedule payment retry: %v\n", workerNum, err)
+		return
+	}
+	p.Store.RecordPaymentTransition(ctx, msg.CorrelationId, models.PaymentTransition{
+		Status:  models.PaymentStatusRetrying,
+		Worker:  &workerNum,
+		Attempt: msg.Attempts,
+		Error:   msg.LastError,
+		RetryAt: &retryAt,
+	})
+}
+
+// promoteDueRetries moves retries whose backoff expired back to the main queue.
+func (p *PaymentProcessor) promoteDueRetries(ctx context.Context) {
+	ticker := time.NewTicker(p.retryPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
 		}
 
-		if err := p.ProcessPayments(payment); err != nil {
-			fmt.Printf("[Worker %v] Failed to process payment: %v\n", workerNum, err)
-			p.Store.RedisClient.LPush(ctx, "payments:queue", result) // Requeue the payment
-		} else {
-			// Successfully processed - remove from processing queue
-			p.Store.RedisClient.LRem(ctx, processingQueue, 1, result)
+		for {
+			moved, err := p.retries.PromoteDueRetries(ctx, time.Now(), promoteRetriesBatchSize)
+			if err != nil {
+				fmt.Printf("[Retry] Failed to promote due retries: %v\n", err)
+				break
+			}
+			if moved < promoteRetriesBatchSize {
+				break
+			}
 		}
 	}
 }
 
-func (p *PaymentProcessor) ProcessPayments(paymentRequest models.PaymentRequest) error {
+// ProcessPayments sends the payment to the healthy processor and returns the service that accepted it.
+func (p *PaymentProcessor) ProcessPayments(paymentRequest models.PaymentRequest) (string, error) {
 	// evita que o health checker mude no meio
-	currentProcessor := p.health.HealthyProcessor
+	currentProcessor := p.health.HealthyProcessor()
 	if currentProcessor == nil {
-		return fmt.Errorf("no healthy processor available")
+		return "", fmt.Errorf("no healthy processor available")
 	}
 
 	paymentRequestForProcessor := struct {
-		CorrelationId uuid.UUID `json:"correlationId"`
-		Amount        float64   `json:"amount"`
-		RequestedAt   time.Time `json:"requestedAt"`
+		CorrelationId uuid.UUID    `json:"correlationId"`
+		Amount        models.Money `json:"amount"`
+		RequestedAt   time.Time    `json:"requestedAt"`
 	}{
 		CorrelationId: paymentRequest.CorrelationId,
-		Amount:        float64(paymentRequest.Amount) / 100.0,
+		Amount:        paymentRequest.Amount,
 		RequestedAt:   paymentRequest.RequestedAt,
 	}
 
 	requestBody, err := json.Marshal(paymentRequestForProcessor)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	resp, err := p.client.Post(currentProcessor.URL, "application/json", bytes.NewBuffer(requestBody))
+	resp, err := p.sendPayment(currentProcessor, requestBody)
 	if err != nil {
-		return fmt.Errorf("failed to send payment request to processor %s: %w", currentProcessor.Service, err)
+		err = fmt.Errorf("failed to send payment request to processor %s: %w", currentProcessor.Service, err)
+		if !isDialError(err) {
+			// The request may have reached the processor, only it can tell whether it was charged
+			return "", &AmbiguousOutcomeError{Service: currentProcessor.Service, Err: err}
+		}
+		return "", err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return fmt.Errorf("error sending to payment processor %s: status %d", currentProcessor.Service, resp.StatusCode)
+		return "", classifyResponse(currentProcessor.Service, resp)
 	}
 
+	return currentProcessor.Service, nil // Use captured processor
+}
+
+func (p *PaymentProcessor) sendPayment(destination *health.PaymentProcessorDestination, requestBody []byte) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), destination.Timeout)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, destination.PaymentsURL(), bytes.NewReader(requestBody))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	// The timeout covers reading the body too, it is cancelled once the caller closes it
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+// settle records a payment the processor accepted and acks its delivery.
+func (p *PaymentProcessor) settle(ctx context.Context, delivery queue.Delivery, paymentRequest models.PaymentRequest, service string) {
 	processedPayment := models.Payment{
 		PaymentRequest: paymentRequest,
-		Service:        currentProcessor.Service, // Use captured processor
+		Service:        service,
 	}
 
-	err = p.Store.StorePayment(context.Background(), processedPayment)
-	if err != nil {
-		// This is critical - payment was accepted by processor but we failed to save
-		// Log as error but don't return error to avoid reprocessing
-		// log.Printf("CRITICAL: Payment accepted by processor but failed to save in Redis: %v", err)
+	p.Store.RecordPaymentTransition(ctx, paymentRequest.CorrelationId, models.PaymentTransition{
+		Status:    models.PaymentStatusProcessed,
+		Processor: service,
+	})
+
+	acked, err := p.Store.SettlePayment(ctx, processedPayment, delivery)
+	if err != nil && !errors.Is(err, store.ErrPaymentAlreadyStored) {
+		// This is critical - payment was accepted by processor but we failed to save.
+		// Keep it in the outbox so the flusher records it once Redis is back
+		if outboxErr := p.Outbox.Append(processedPayment); outboxErr != nil {
+			// Leave the delivery unacked, the reaper requeues it and the processor reports it as already processed
+			fmt.Printf("CRITICAL: Payment %v accepted by processor but neither stored nor written to the outbox: %v, %v\n", paymentRequest.CorrelationId, err, outboxErr)
+			return
+		}
+		p.Queue.Ack(ctx, delivery)
+		return
 	}
 
-	return nil
+	if !acked {
+		p.Queue.Ack(ctx, delivery)
+	}
 }
@@ -0,0 +1,36 @@
+package distributor
+
+import (
+	"context"
+	"errors"
+	"rinha-backend-arthur/internal/store"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// settledCheckFails answers the settled check like a store that is down.
+type settledCheckFails struct {
+	store.Store
+}
+
+func (settledCheckFails) IsPaymentSettled(ctx context.Context, correlationId uuid.UUID) (bool, error) {
+	return false, errors.New("connection refused")
+}
+
+func TestUnknownSettledStateWaitsInsteadOfSending(t *testing.T) {
+	standIn := newProcessorStandIn(t)
+	p, paymentStore, q := newTestProcessor(t, standIn)
+	p.Store = settledCheckFails{paymentStore}
+	ctx := context.Background()
+
+	correlationId := uuid.New()
+	p.processDelivery(ctx, 0, deliver(t, q, paymentMessage(correlationId)))
+
+	if posts := standIn.posts.Load(); posts != 0 {
+		t.Fatalf("processor got %d POSTs while the store was down, want none", posts)
+	}
+	if next := retried(t, q); next.CorrelationId != correlationId || next.Attempts != 0 {
+		t.Fatalf("retry = %+v, want the payment back without using an attempt", next)
+	}
+}
@@ -0,0 +1,86 @@
+package distributor
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type ErrorClass string
+
+const (
+	ErrorClassRetryable        ErrorClass = "retryable"
+	ErrorClassTerminal         ErrorClass = "terminal"
+	ErrorClassAlreadyProcessed ErrorClass = "already_processed"
+	ErrorClassRateLimited      ErrorClass = "rate_limited"
+	ErrorClassAmbiguous        ErrorClass = "ambiguous"
+)
+
+// ProcessorError is a failed payment request classified by how the worker should react to it.
+type ProcessorError struct {
+	Class      ErrorClass
+	Service    string
+	StatusCode int
+	RetryAfter time.Duration // only set for ErrorClassRateLimited
+	Err        error
+}
+
+func (e *ProcessorError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s error on processor %s: %v", e.Class, e.Service, e.Err)
+	}
+	return fmt.Sprintf("%s error on processor %s: status %d", e.Class, e.Service, e.StatusCode)
+}
+
+func (e *ProcessorError) Unwrap() error {
+	return e.Err
+}
+
+// classOf returns the class of a ProcessPayments error, errors that weren't classified are retryable.
+func classOf(err error) ErrorClass {
+	var processorErr *ProcessorError
+	if errors.As(err, &processorErr) {
+		return processorErr.Class
+	}
+	var ambiguous *AmbiguousOutcomeError
+	if errors.As(err, &ambiguous) {
+		return ErrorClassAmbiguous
+	}
+	return ErrorClassRetryable
+}
+
+// classifyResponse turns a non-2xx processor response into a ProcessorError.
+func classifyResponse(service string, resp *http.Response) *ProcessorError {
+	processorErr := &ProcessorError{Service: service, StatusCode: resp.StatusCode}
+
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		processorErr.Class = ErrorClassRateLimited
+		processorErr.RetryAfter = parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+	case resp.StatusCode == http.StatusConflict || resp.StatusCode == http.StatusUnprocessableEntity:
+		// The processor answers these for a correlationId it already has, confirmed with a lookup
+		processorErr.Class = ErrorClassAlreadyProcessed
+	case resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode >= 500:
+		processorErr.Class = ErrorClassRetryable
+	default:
+		processorErr.Class = ErrorClassTerminal
+	}
+
+	return processorErr
+}
+
+// parseRetryAfter reads a Retry-After header given in seconds or as an HTTP date.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil && at.After(now) {
+		return at.Sub(now)
+	}
+	return 0
+}
@@ -0,0 +1,82 @@
+package distributor
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestClassifyResponse(t *testing.T) {
+	tests := []struct {
+		status     int
+		retryAfter string
+		class      ErrorClass
+		wait       time.Duration
+	}{
+		{http.StatusTooManyRequests, "3", ErrorClassRateLimited, 3 * time.Second},
+		{http.StatusTooManyRequests, "", ErrorClassRateLimited, 0},
+		{http.StatusConflict, "", ErrorClassAlreadyProcessed, 0},
+		{http.StatusUnprocessableEntity, "", ErrorClassAlreadyProcessed, 0},
+		{http.StatusRequestTimeout, "", ErrorClassRetryable, 0},
+		{http.StatusInternalServerError, "", ErrorClassRetryable, 0},
+		{http.StatusBadGateway, "", ErrorClassRetryable, 0},
+		{http.StatusServiceUnavailable, "5", ErrorClassRetryable, 0}, // Retry-After only counts when rate limited
+		{http.StatusBadRequest, "", ErrorClassTerminal, 0},
+		{http.StatusUnauthorized, "", ErrorClassTerminal, 0},
+		{http.StatusNotFound, "", ErrorClassTerminal, 0},
+	}
+
+	for _, tt := range tests {
+		resp := &http.Response{StatusCode: tt.status, Header: http.Header{}}
+		if tt.retryAfter != "" {
+			resp.Header.Set("Retry-After", tt.retryAfter)
+		}
+
+		got := classifyResponse("default", resp)
+		if got.Class != tt.class || got.RetryAfter != tt.wait || got.StatusCode != tt.status || got.Service != "default" {
+			t.Errorf("classifyResponse(%d, Retry-After %q) = %+v, want %s waiting %v", tt.status, tt.retryAfter, got, tt.class, tt.wait)
+		}
+		if class := classOf(got); class != tt.class {
+			t.Errorf("classOf(%d) = %s, want %s", tt.status, class, tt.class)
+		}
+	}
+}
+
+func TestClassOf(t *testing.T) {
+	if class := classOf(errors.New("connection refused")); class != ErrorClassRetryable {
+		t.Errorf("classOf(unclassified) = %s, want retryable", class)
+	}
+	if class := classOf(&AmbiguousOutcomeError{}); class != ErrorClassAmbiguous {
+		t.Errorf("classOf(ambiguous) = %s, want ambiguous", class)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2025, 7, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", 0},
+		{"1", time.Second},
+		{"120", 2 * time.Minute},
+		{"0", 0},
+		{"-5", 0},
+		{"1.5", 0},
+		{"soon", 0},
+		{now.Add(90 * time.Second).Format(http.TimeFormat), 90 * time.Second},
+		{now.Add(-time.Minute).Format(http.TimeFormat), 0}, // already past
+		{"Tue, 01 Jul 2025 12:00:30 GMT", 30 * time.Second},
+		{"Tuesday, 01-Jul-25 12:00:30 GMT", 30 * time.Second}, // RFC 850
+		{"Tue Jul  1 12:00:30 2025", 30 * time.Second},        // ANSI C asctime
+		{"2025-07-01T12:00:30Z", 0},                           // not an HTTP date
+	}
+
+	for _, tt := range tests {
+		if got := parseRetryAfter(tt.value, now); got != tt.want {
+			t.Errorf("parseRetryAfter(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
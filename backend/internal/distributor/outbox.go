@@ -0,0 +1,40 @@
+package distributor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"rinha-backend-arthur/internal/models"
+	"rinha-backend-arthur/internal/store"
+	"time"
+)
+
+// flushOutbox keeps retrying the payments the processor accepted but Redis failed to record.
+func (p *PaymentProcessor) flushOutbox(ctx context.Context) {
+	ticker := time.NewTicker(p.outboxInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		flushed, err := p.Outbox.Flush(ctx, p.storeFromOutbox)
+		if err != nil && ctx.Err() == nil {
+			fmt.Printf("[Outbox] Failed to flush payments, %d still pending: %v\n", p.Outbox.Backlog(), err)
+		}
+		if flushed > 0 {
+			fmt.Printf("[Outbox] Stored %d payments\n", flushed)
+		}
+	}
+}
+
+func (p *PaymentProcessor) storeFromOutbox(ctx context.Context, payment models.Payment) error {
+	err := p.Store.StorePayment(ctx, payment)
+	if errors.Is(err, store.ErrPaymentAlreadyStored) {
+		return nil
+	}
+	return err
+}
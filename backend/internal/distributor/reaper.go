@@ -0,0 +1,28 @@
+package distributor
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// reapOrphanedPayments requeues deliveries left behind by workers that died mid-request.
+func (p *PaymentProcessor) reapOrphanedPayments(ctx context.Context) {
+	ticker := time.NewTicker(p.reaperInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		reaped, err := p.retries.Reap(ctx, p.visibilityTimeout)
+		if err != nil {
+			fmt.Printf("[Reaper] Failed to reap orphaned payments: %v\n", err)
+		} else if reaped > 0 {
+			fmt.Printf("[Reaper] Requeued %d orphaned payments\n", reaped)
+		}
+	}
+}
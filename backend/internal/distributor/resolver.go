@@ -0,0 +1,140 @@
+package distributor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"rinha-backend-arthur/internal/models"
+	"rinha-backend-arthur/internal/queue"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// AmbiguousOutcomeError means the payment request may have reached the processor
+// (timeout or dropped connection after sending), so it may or may not have been charged.
+type AmbiguousOutcomeError struct {
+	Service string
+	Err     error
+}
+
+func (e *AmbiguousOutcomeError) Error() string {
+	return fmt.Sprintf("ambiguous outcome on processor %s: %v", e.Service, e.Err)
+}
+
+func (e *AmbiguousOutcomeError) Unwrap() error {
+	return e.Err
+}
+
+type outcome int
+
+const (
+	outcomeUnknown outcome = iota
+	outcomeProcessed
+	outcomeNotProcessed
+)
+
+// isDialError tells whether the request failed before a connection was made,
+// in which case the processor never saw it.
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// resolveAmbiguousOutcome asks the processor whether it has the payment after an ambiguous failure.
+// It returns nil when the payment was settled as processed. Otherwise the returned error goes
+// through the usual retry, and when the processor couldn't answer the delivery is marked so the
+// next attempt asks again instead of sending the payment a second time.
+func (p *PaymentProcessor) resolveAmbiguousOutcome(ctx context.Context, delivery *queue.Delivery, ambiguous *AmbiguousOutcomeError) error {
+	result, processed, err := p.queryProcessor(ctx, ambiguous.Service, delivery.Message.CorrelationId)
+	switch result {
+	case outcomeProcessed:
+		p.settle(ctx, *delivery, processed, ambiguous.Service)
+		return nil
+	case outcomeNotProcessed:
+		return ambiguous.Err
+	default:
+		delivery.Message.AmbiguousProcessor = ambiguous.Service
+		return fmt.Errorf("%w (outcome unresolved: %v)", ambiguous, err)
+	}
+}
+
+// resolvePreviousAttempt settles a delivery whose previous attempt had an unresolved ambiguous
+// outcome. It returns true when the processor doesn't have the payment and it can be sent again.
+func (p *PaymentProcessor) resolvePreviousAttempt(ctx context.Context, workerNum int, delivery queue.Delivery, service string) bool {
+	result, processed, err := p.queryProcessor(ctx, service, delivery.Message.CorrelationId)
+	switch result {
+	case outcomeProcessed:
+		p.settle(ctx, delivery, processed, service)
+		return false
+	case outcomeNotProcessed:
+		return true
+	default:
+		p.handleFailedPayment(ctx, workerNum, delivery, fmt.Errorf("outcome on processor %s still unresolved: %w", service, err))
+		return false
+	}
+}
+
+// resolveAlreadyProcessed confirms a conflict answer with a lookup. It returns nil when the
+// processor has the payment and it was settled, a terminal error when it doesn't.
+func (p *PaymentProcessor) resolveAlreadyProcessed(ctx context.Context, delivery *queue.Delivery, processorErr *ProcessorError) error {
+	result, processed, err := p.queryProcessor(ctx, processorErr.Service, delivery.Message.CorrelationId)
+	switch result {
+	case outcomeProcessed:
+		p.settle(ctx, *delivery, processed, processorErr.Service)
+		return nil
+	case outcomeNotProcessed:
+		return &ProcessorError{Class: ErrorClassTerminal, Service: processorErr.Service, StatusCode: processorErr.StatusCode}
+	default:
+		delivery.Message.AmbiguousProcessor = processorErr.Service
+		return fmt.Errorf("%w (lookup failed: %v)", processorErr, err)
+	}
+}
+
+// queryProcessor looks the payment up with the processor's GET /payments/{id}.
+func (p *PaymentProcessor) queryProcessor(ctx context.Context, service string, correlationId uuid.UUID) (outcome, models.PaymentRequest, error) {
+	destination := p.health.Destination(service)
+	if destination == nil {
+		return outcomeUnknown, models.PaymentRequest{}, fmt.Errorf("unknown processor %s", service)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, destination.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, destination.PaymentsURL()+"/"+correlationId.String(), nil)
+	if err != nil {
+		return outcomeUnknown, models.PaymentRequest{}, err
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return outcomeUnknown, models.PaymentRequest{}, fmt.Errorf("failed to query processor %s: %w", service, err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return outcomeNotProcessed, models.PaymentRequest{}, nil
+	case resp.StatusCode < 200 || resp.StatusCode >= 300:
+		return outcomeUnknown, models.PaymentRequest{}, fmt.Errorf("error querying processor %s: status %d", service, resp.StatusCode)
+	}
+
+	var processed struct {
+		CorrelationId uuid.UUID    `json:"correlationId"`
+		Amount        models.Money `json:"amount"`
+		RequestedAt   time.Time    `json:"requestedAt"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&processed); err != nil {
+		return outcomeUnknown, models.PaymentRequest{}, fmt.Errorf("failed to decode processor %s response: %w", service, err)
+	}
+
+	// Record what the processor has, that is what the audit compares against
+	return outcomeProcessed, models.PaymentRequest{
+		CorrelationId: processed.CorrelationId,
+		Amount:        processed.Amount,
+		RequestedAt:   processed.RequestedAt.UTC(),
+	}, nil
+}
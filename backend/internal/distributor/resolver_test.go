@@ -0,0 +1,198 @@
+package distributor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"rinha-backend-arthur/internal/health"
+	"rinha-backend-arthur/internal/models"
+	"rinha-backend-arthur/internal/outbox"
+	"rinha-backend-arthur/internal/queue"
+	"rinha-backend-arthur/internal/store"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// processorStandIn plays a payment processor. POST /payments hangs past the client timeout
+// while hang is set, GET /payments/{id} answers lookupStatus.
+type processorStandIn struct {
+	*httptest.Server
+	posts        atomic.Int32
+	hang         atomic.Bool
+	lookupStatus atomic.Int32
+	amount       models.Money
+}
+
+func newProcessorStandIn(t *testing.T) *processorStandIn {
+	t.Helper()
+	standIn := &processorStandIn{amount: 1990}
+	standIn.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/payments":
+			standIn.posts.Add(1)
+			if standIn.hang.Load() {
+				time.Sleep(200 * time.Millisecond)
+			}
+			w.WriteHeader(http.StatusOK)
+		case r.Method == http.MethodGet && len(r.URL.Path) > len("/payments/"):
+			status := int(standIn.lookupStatus.Load())
+			w.WriteHeader(status)
+			if status == http.StatusOK {
+				fmt.Fprintf(w, `{"correlationId":%q,"amount":%s,"requestedAt":"2025-07-01T12:00:00Z"}`,
+					r.URL.Path[len("/payments/"):], standIn.amount)
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(standIn.Close)
+	return standIn
+}
+
+func newTestProcessor(t *testing.T, standIn *processorStandIn) (*PaymentProcessor, store.Store, *queue.MemoryQueue) {
+	t.Helper()
+	paymentOutbox, err := outbox.Open(filepath.Join(t.TempDir(), "outbox.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { paymentOutbox.Close() })
+
+	paymentStore := store.NewMemoryStore()
+	paymentQueue := queue.NewMemoryQueue(10)
+	return &PaymentProcessor{
+		Store:       paymentStore,
+		Queue:       paymentQueue,
+		Outbox:      paymentOutbox,
+		deadLetters: paymentQueue,
+		retries:     paymentQueue,
+		maxAttempts: 5,
+		backoff:     BackoffConfig{BaseDelay: time.Millisecond, MaxDelay: time.Millisecond},
+		client:      &http.Client{},
+		health: health.NewHealthCheckService(paymentStore, []health.PaymentProcessorDestination{{
+			Service:      "default",
+			BaseURL:      standIn.URL,
+			PaymentsPath: "/payments",
+			HealthPath:   "/payments/service-health",
+			Timeout:      50 * time.Millisecond,
+		}}),
+	}, paymentStore, paymentQueue
+}
+
+// deliver enqueues a payment and hands its delivery out like a worker would get it.
+func deliver(t *testing.T, q *queue.MemoryQueue, msg models.QueueMessage) queue.Delivery {
+	t.Helper()
+	ctx := context.Background()
+	if err := q.Enqueue(ctx, msg); err != nil {
+		t.Fatal(err)
+	}
+	deliveries, err := q.Dequeue(ctx, 0, 1, time.Second)
+	if err != nil || len(deliveries) != 1 {
+		t.Fatalf("Dequeue = %v, %v", deliveries, err)
+	}
+	return deliveries[0]
+}
+
+func paymentMessage(correlationId uuid.UUID) models.QueueMessage {
+	payload, _ := json.Marshal(map[string]any{"correlationId": correlationId, "amount": 19.90})
+	return models.QueueMessage{CorrelationId: correlationId, Payload: payload}
+}
+
+// retried promotes the retries and returns the message that came back, failing when there is none.
+func retried(t *testing.T, q *queue.MemoryQueue) models.QueueMessage {
+	t.Helper()
+	ctx := context.Background()
+	if _, err := q.PromoteDueRetries(ctx, time.Now().Add(time.Hour), 10); err != nil {
+		t.Fatal(err)
+	}
+	deliveries, err := q.Dequeue(ctx, 0, 1, 10*time.Millisecond)
+	if err != nil || len(deliveries) != 1 {
+		t.Fatalf("no retry scheduled: %v, %v", deliveries, err)
+	}
+	return deliveries[0].Message
+}
+
+func TestAmbiguousOutcomeFoundByLookupIsSettledWithoutResend(t *testing.T) {
+	standIn := newProcessorStandIn(t)
+	standIn.hang.Store(true)
+	standIn.lookupStatus.Store(http.StatusOK)
+	p, paymentStore, q := newTestProcessor(t, standIn)
+	ctx := context.Background()
+
+	correlationId := uuid.New()
+	p.processDelivery(ctx, 0, deliver(t, q, paymentMessage(correlationId)))
+
+	if posts := standIn.posts.Load(); posts != 1 {
+		t.Fatalf("processor got %d POSTs, want the timed out one only", posts)
+	}
+	if settled, _ := paymentStore.IsPaymentSettled(ctx, correlationId); !settled {
+		t.Fatal("payment the processor has was not settled")
+	}
+	payments, _ := paymentStore.GetPaymentsByTime(ctx, time.Time{}, time.Now().Add(time.Hour))
+	if len(payments) != 1 || payments[0].Amount != standIn.amount || payments[0].Service != "default" {
+		t.Fatalf("stored %+v, want what the processor has", payments)
+	}
+	if depth, _ := q.Depth(ctx); depth.Processing != 0 || depth.Retrying != 0 {
+		t.Fatalf("queue after settling = %+v, want the delivery acked", depth)
+	}
+}
+
+func TestAmbiguousOutcomeNotFoundIsResent(t *testing.T) {
+	standIn := newProcessorStandIn(t)
+	standIn.lookupStatus.Store(http.StatusNotFound)
+	p, paymentStore, q := newTestProcessor(t, standIn)
+	ctx := context.Background()
+
+	// The previous attempt timed out on default and its lookup failed
+	correlationId := uuid.New()
+	msg := paymentMessage(correlationId)
+	msg.AmbiguousProcessor = "default"
+	p.processDelivery(ctx, 0, deliver(t, q, msg))
+
+	if posts := standIn.posts.Load(); posts != 1 {
+		t.Fatalf("processor got %d POSTs, want the payment resent once", posts)
+	}
+	if settled, _ := paymentStore.IsPaymentSettled(ctx, correlationId); !settled {
+		t.Fatal("resent payment was not settled")
+	}
+
+	// A timeout whose lookup finds nothing goes through the usual retry, sent again next time
+	standIn.hang.Store(true)
+	p.processDelivery(ctx, 0, deliver(t, q, paymentMessage(uuid.New())))
+	if next := retried(t, q); next.AmbiguousProcessor != "" {
+		t.Fatalf("retry after a lookup found nothing = %+v, want it sent again", next)
+	}
+}
+
+func TestAmbiguousOutcomeUnresolvedKeepsTheProcessor(t *testing.T) {
+	standIn := newProcessorStandIn(t)
+	standIn.hang.Store(true)
+	standIn.lookupStatus.Store(http.StatusInternalServerError)
+	p, paymentStore, q := newTestProcessor(t, standIn)
+	ctx := context.Background()
+
+	correlationId := uuid.New()
+	p.processDelivery(ctx, 0, deliver(t, q, paymentMessage(correlationId)))
+
+	next := retried(t, q)
+	if next.AmbiguousProcessor != "default" || next.Attempts != 1 {
+		t.Fatalf("retry after a failed lookup = %+v, want default kept as the ambiguous processor", next)
+	}
+
+	// The next attempt asks again instead of sending the payment a second time
+	p.processDelivery(ctx, 0, deliver(t, q, next))
+	if posts := standIn.posts.Load(); posts != 1 {
+		t.Fatalf("processor got %d POSTs, want no resend while the outcome is unknown", posts)
+	}
+	if next := retried(t, q); next.AmbiguousProcessor != "default" || next.Attempts != 2 {
+		t.Fatalf("second retry = %+v, want default still kept", next)
+	}
+	if settled, _ := paymentStore.IsPaymentSettled(ctx, correlationId); settled {
+		t.Fatal("payment with an unknown outcome was settled")
+	}
+}
@@ -0,0 +1,119 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"rinha-backend-arthur/internal/models"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// exportFlushEvery is how many rows are buffered before they are sent to the client.
+const exportFlushEvery = 1000
+
+// HandleExportPayments streams the ledger as NDJSON (default) or CSV. The from and to
+// parameters bound requestedAt, either can be left out, and processor keeps only one processor.
+// Rows are written as they are read from the store, so memory doesn't grow with the ledger.
+func (h *Handler) HandleExportPayments(ctx *fasthttp.RequestCtx) {
+	args := ctx.QueryArgs()
+
+	var fieldErrors []models.FieldError
+	from, err := ParseFlexibleTime(string(args.Peek("from")))
+	if err != nil {
+		fieldErrors = append(fieldErrors, models.FieldError{Field: "from", Message: "must be an ISO 8601 timestamp"})
+	}
+	to, err := ParseFlexibleTime(string(args.Peek("to")))
+	if err != nil {
+		fieldErrors = append(fieldErrors, models.FieldError{Field: "to", Message: "must be an ISO 8601 timestamp"})
+	}
+	if len(fieldErrors) == 0 && !from.IsZero() && !to.IsZero() && from.After(to) {
+		fieldErrors = append(fieldErrors, models.FieldError{Field: "from", Message: "must be before or equal to 'to'"})
+	}
+
+	processor := string(args.Peek("processor"))
+	if processor != "" && processor != "default" && processor != "fallback" {
+		fieldErrors = append(fieldErrors, models.FieldError{Field: "processor", Message: "must be default or fallback"})
+	}
+
+	format := string(args.Peek("format"))
+	if format == "" {
+		format = "ndjson"
+	}
+	if format != "ndjson" && format != "csv" {
+		fieldErrors = append(fieldErrors, models.FieldError{Field: "format", Message: "must be ndjson or csv"})
+	}
+
+	if len(fieldErrors) > 0 {
+		sendJSONError(ctx, fasthttp.StatusBadRequest, models.ErrorResponse{
+			Error:  "invalid query parameters",
+			Fields: fieldErrors,
+		})
+		return
+	}
+
+	if format == "csv" {
+		ctx.SetContentType("text/csv")
+	} else {
+		ctx.SetContentType("application/x-ndjson")
+	}
+	ctx.Response.Header.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="payments.%s"`, format))
+	ctx.SetStatusCode(fasthttp.StatusOK)
+
+	paymentStore := h.paymentProcessor.Store
+	ctx.SetBodyStreamWriter(func(w *bufio.Writer) {
+		// The status is already sent, a failure can only cut the export short
+		writeRow := exportRowWriter(w, format)
+		rows := 0
+
+		err := paymentStore.StreamPayments(context.Background(), from, to, func(payment models.Payment) error {
+			if processor != "" && payment.Service != processor {
+				return nil
+			}
+			if err := writeRow(payment); err != nil {
+				return err
+			}
+			rows++
+			if rows%exportFlushEvery == 0 {
+				return w.Flush()
+			}
+			return nil
+		})
+		if err != nil {
+			fmt.Printf("[Export] Payment export stopped after %d rows: %v\n", rows, err)
+			return
+		}
+		w.Flush()
+	})
+}
+
+// exportRowWriter returns a function writing one payment in the given format, CSV starts with a header.
+func exportRowWriter(w *bufio.Writer, format string) func(models.Payment) error {
+	if format == "csv" {
+		csvWriter := csv.NewWriter(w)
+		csvWriter.Write([]string{"correlationId", "amount", "requestedAt", "processor"})
+		return func(payment models.Payment) error {
+			csvWriter.Write([]string{
+				payment.CorrelationId.String(),
+				payment.Amount.String(),
+				payment.RequestedAt.Format(time.RFC3339Nano),
+				payment.Service,
+			})
+			csvWriter.Flush()
+			return csvWriter.Error()
+		}
+	}
+
+	encoder := json.NewEncoder(w)
+	return func(payment models.Payment) error {
+		return encoder.Encode(models.PaymentExportRecord{
+			CorrelationId: payment.CorrelationId,
+			Amount:        payment.Amount,
+			RequestedAt:   payment.RequestedAt,
+			Processor:     payment.Service,
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package internal
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"rinha-backend-arthur/internal/distributor"
+	"rinha-backend-arthur/internal/models"
+	"rinha-backend-arthur/internal/store"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/valyala/fasthttp"
+)
+
+func exportHandler(t *testing.T, payments ...models.Payment) *Handler {
+	t.Helper()
+	paymentStore := store.NewMemoryStore()
+	for _, payment := range payments {
+		if err := paymentStore.StorePayment(context.Background(), payment); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &Handler{paymentProcessor: &distributor.PaymentProcessor{Store: paymentStore}}
+}
+
+func export(h *Handler, query string) *fasthttp.RequestCtx {
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.SetRequestURI("/payments/export?" + query)
+	h.HandleExportPayments(ctx)
+	return ctx
+}
+
+func TestHandleExportPayments(t *testing.T) {
+	base := time.Date(2025, 7, 1, 12, 0, 0, 0, time.UTC)
+	payments := make([]models.Payment, 4)
+	for i := range payments {
+		service := "default"
+		if i == 2 {
+			service = "fallback"
+		}
+		payments[i] = models.Payment{
+			PaymentRequest: models.PaymentRequest{
+				CorrelationId: uuid.New(),
+				Amount:        models.Money(1990 + i),
+				RequestedAt:   base.Add(time.Duration(i) * time.Minute),
+			},
+			Service: service,
+		}
+	}
+	h := exportHandler(t, payments...)
+
+	t.Run("ndjson", func(t *testing.T) {
+		ctx := export(h, "from="+base.Add(time.Minute).Format(time.RFC3339)+"&to="+base.Add(2*time.Minute).Format(time.RFC3339))
+		if ctx.Response.StatusCode() != fasthttp.StatusOK || string(ctx.Response.Header.ContentType()) != "application/x-ndjson" {
+			t.Fatalf("status %d, content type %s", ctx.Response.StatusCode(), ctx.Response.Header.ContentType())
+		}
+
+		lines := strings.Split(strings.TrimSuffix(string(ctx.Response.Body()), "\n"), "\n")
+		if len(lines) != 2 {
+			t.Fatalf("exported %d rows from 1 to 2 minutes in, want 2:\n%s", len(lines), ctx.Response.Body())
+		}
+		for i, line := range lines {
+			var record models.PaymentExportRecord
+			if err := json.Unmarshal([]byte(line), &record); err != nil {
+				t.Fatalf("row %d is not JSON: %v", i, err)
+			}
+			want := payments[i+1]
+			if record.CorrelationId != want.CorrelationId || record.Amount != want.Amount ||
+				!record.RequestedAt.Equal(want.RequestedAt) || record.Processor != want.Service {
+				t.Fatalf("row %d = %+v, want %+v", i, record, want)
+			}
+		}
+		if !strings.Contains(lines[0], `"amount":19.91`) {
+			t.Fatalf("row %s doesn't carry the amount in units", lines[0])
+		}
+	})
+
+	t.Run("csv", func(t *testing.T) {
+		ctx := export(h, "format=csv&processor=default&from="+base.Add(time.Minute).Format(time.RFC3339))
+		if ctx.Response.StatusCode() != fasthttp.StatusOK || string(ctx.Response.Header.ContentType()) != "text/csv" {
+			t.Fatalf("status %d, content type %s", ctx.Response.StatusCode(), ctx.Response.Header.ContentType())
+		}
+
+		rows, err := csv.NewReader(strings.NewReader(string(ctx.Response.Body()))).ReadAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := [][]string{
+			{"correlationId", "amount", "requestedAt", "processor"},
+			{payments[1].CorrelationId.String(), "19.91", "2025-07-01T12:01:00Z", "default"},
+			{payments[3].CorrelationId.String(), "19.93", "2025-07-01T12:03:00Z", "default"},
+		}
+		if len(rows) != len(want) {
+			t.Fatalf("exported %v, want %v", rows, want)
+		}
+		for i := range want {
+			if strings.Join(rows[i], ",") != strings.Join(want[i], ",") {
+				t.Fatalf("row %d = %v, want %v", i, rows[i], want[i])
+			}
+		}
+	})
+
+	t.Run("invalid parameters", func(t *testing.T) {
+		for _, query := range []string{
+			"from=yesterday",
+			"from=2025-07-02T00:00:00Z&to=2025-07-01T00:00:00Z",
+			"processor=other",
+			"format=xml",
+		} {
+			if ctx := export(h, query); ctx.Response.StatusCode() != fasthttp.StatusBadRequest {
+				t.Errorf("%s: status = %d, want 400", query, ctx.Response.StatusCode())
+			}
+		}
+	})
+}
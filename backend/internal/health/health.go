@@ -1,63 +1,115 @@
 package health
 
 import (
+	"cmp"
 	"context"
 	"encoding/json"
 	"net/http"
 	"rinha-backend-arthur/internal/models"
 	"rinha-backend-arthur/internal/store"
+	"slices"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
 type HealthCheckService struct {
-	store            *store.Store
-	HealthyProcessor *PaymentProcessorDestination
+	store            store.Store
+	client           *http.Client
+	destinations     []*PaymentProcessorDestination // cheapest first
+	healthyProcessor atomic.Pointer[PaymentProcessorDestination]
 }
 
+// PaymentProcessorDestination is a payment processor and how to reach it.
 type PaymentProcessorDestination struct {
-	URL        string
-	HEALTH_URL string // health check URL
-	Service    string // default or fallback
+	Service      string // default or fallback
+	BaseURL      string
+	PaymentsPath string
+	HealthPath   string
+	Timeout      time.Duration // per request
+	Fee          float64       // share of each amount the processor keeps, only used to order destinations
 }
 
-var (
-	DEFAULT_PAYMENT_PROCESSOR_URL  = "http://payment-processor-default:8080/payments"
-	FALLBACK_PAYMENT_PROCESSOR_URL = "http://payment-processor-fallback:8080/payments"
-	DEFAULT_HEALTH_URL             = "http://payment-processor-default:8080/payments/service-health"
-	FALLBACK_HEALTH_URL            = "http://payment-processor-fallback:8080/payments/service-health"
-)
+func (d *PaymentProcessorDestination) PaymentsURL() string {
+	return strings.TrimSuffix(d.BaseURL, "/") + d.PaymentsPath
+}
+
+func (d *PaymentProcessorDestination) HealthURL() string {
+	return strings.TrimSuffix(d.BaseURL, "/") + d.HealthPath
+}
+
+const healthCheckLockName = "health_check_lock"
+
+// NewHealthCheckService prefers the cheapest healthy processor, destinations with the same
+// fee keep their order. It starts on the cheapest one until the first check.
+func NewHealthCheckService(store store.Store, destinations []PaymentProcessorDestination) *HealthCheckService {
+	h := &HealthCheckService{
+		store:  store,
+		client: &http.Client{},
+	}
+	for _, destination := range destinations {
+		h.destinations = append(h.destinations, &destination)
+	}
+	slices.SortStableFunc(h.destinations, func(a, b *PaymentProcessorDestination) int {
+		return cmp.Compare(a.Fee, b.Fee)
+	})
+	if len(h.destinations) > 0 {
+		h.healthyProcessor.Store(h.destinations[0])
+	}
+	return h
+}
+
+// HealthyProcessor is the destination payments go to, nil when no destination is configured.
+// Workers read it while the health check loop replaces it.
+func (h *HealthCheckService) HealthyProcessor() *PaymentProcessorDestination {
+	return h.healthyProcessor.Load()
+}
 
-func NewHealthCheckService(store *store.Store) *HealthCheckService {
-	return &HealthCheckService{
-		store: store,
-		HealthyProcessor: &PaymentProcessorDestination{
-			URL:        DEFAULT_PAYMENT_PROCESSOR_URL,
-			HEALTH_URL: DEFAULT_HEALTH_URL,
-			Service:    "default",
-		},
+// Destination returns the processor destination for a service name, nil when it is unknown.
+func (h *HealthCheckService) Destination(service string) *PaymentProcessorDestination {
+	for _, destination := range h.destinations {
+		if destination.Service == service {
+			return destination
+		}
 	}
+	return nil
 }
 
-func (h *HealthCheckService) StartHealthCheckLoop() {
+// StartHealthCheckLoop checks the processors, or follows the replica checking them, until ctx is cancelled.
+func (h *HealthCheckService) StartHealthCheckLoop(ctx context.Context) {
 	ticker := time.NewTicker(6 * time.Second) // Slightly longer than rate limit
 	defer ticker.Stop()
 
-	for range ticker.C {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
 		// Try to acquire lock for health check
-		if h.acquireHealthCheckLock() {
+		if token := h.acquireHealthCheckLock(); token != "" {
 			// log.Printf("🔐 Acquired health check lock, performing health checks...")
-			h.updateHealthyProcessorWithRedis()
-			h.releaseHealthCheckLock()
+			h.updateHealthyProcessor()
+			h.releaseHealthCheckLock(token)
 		} else {
 			// log.Printf("📖 Another replica is doing health checks, reading status from Redis...")
-			h.readHealthStatusFromRedis()
+			h.readHealthStatus()
 		}
 	}
 }
 
-func (h *HealthCheckService) isHealthy(url string) bool {
+func (h *HealthCheckService) isHealthy(destination *PaymentProcessorDestination) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), destination.Timeout)
+	defer cancel()
+
+	url := destination.HealthURL()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return false
+	}
 
-	resp, err := http.Get(url)
+	resp, err := h.client.Do(req)
 	if err != nil {
 		// log.Printf("Health check request failed for %s: %v", url, err)
 		return false
@@ -78,74 +130,54 @@ func (h *HealthCheckService) isHealthy(url string) bool {
 	return true
 }
 
-func (h *HealthCheckService) acquireHealthCheckLock() bool {
+// acquireHealthCheckLock returns the token releasing the lock, empty when another replica holds it.
+func (h *HealthCheckService) acquireHealthCheckLock() string {
 	ctx := context.Background()
 	// Try to set lock with 10 second expiration (in case process crashes)
-	result := h.store.RedisClient.SetNX(ctx, "health_check_lock", "locked", 10*time.Second)
-	acquired := result.Val()
-	if acquired {
+	token, _ := h.store.AcquireLock(ctx, healthCheckLockName, 10*time.Second)
+	if token != "" {
 		// log.Printf("✅ Health check lock acquired")
 	}
-	return acquired
+	return token
 }
 
-func (h *HealthCheckService) releaseHealthCheckLock() {
+func (h *HealthCheckService) releaseHealthCheckLock(token string) {
 	ctx := context.Background()
-	h.store.RedisClient.Del(ctx, "health_check_lock")
+	h.store.ReleaseLock(ctx, healthCheckLockName, token)
 	// log.Printf("🔓 Health check lock released")
 }
 
-func (h *HealthCheckService) updateHealthyProcessorWithRedis() {
+func (h *HealthCheckService) updateHealthyProcessor() {
 	// log.Printf("=== Starting health check cycle ===")
 
-	// Check main processor first
-	mainHealthy := h.isHealthy(DEFAULT_HEALTH_URL)
-	// log.Printf("Main processor health: %v", mainHealthy)
-
-	if mainHealthy {
-		newProcessor := &PaymentProcessorDestination{
-			URL:     DEFAULT_PAYMENT_PROCESSOR_URL,
-			Service: "default",
+	// Cheapest processor first
+	for _, destination := range h.destinations {
+		healthy := h.isHealthy(destination)
+		// log.Printf("%s processor health: %v", destination.Service, healthy)
+
+		if healthy {
+			if current := h.HealthyProcessor(); current == nil || current.Service != destination.Service {
+				// log.Printf("🔄 Switching to %s processor", destination.Service)
+			}
+			h.healthyProcessor.Store(destination)
+			h.storeHealthStatus(destination.Service)
+			return
 		}
-		if h.HealthyProcessor.Service != "default" {
-			// log.Printf("🔄 Switching to main processor (default)")
-		}
-		h.HealthyProcessor = newProcessor
-		h.storeHealthStatusInRedis("default")
-		return
 	}
 
-	// Check fallback processor
-	fallbackHealthy := h.isHealthy(FALLBACK_HEALTH_URL)
-	// log.Printf("Fallback processor health: %v", fallbackHealthy)
-
-	if fallbackHealthy {
-		newProcessor := &PaymentProcessorDestination{
-			URL:     FALLBACK_PAYMENT_PROCESSOR_URL,
-			Service: "fallback",
-		}
-		if h.HealthyProcessor.Service != "fallback" {
-			// log.Printf("🔄 Switching to fallback processor")
-		}
-		h.HealthyProcessor = newProcessor
-		h.storeHealthStatusInRedis("fallback")
+	// All are down, keep current but update timestamp
+	current := h.HealthyProcessor()
+	if current == nil {
 		return
 	}
-
-	// Both are down, keep current but update timestamp
-	// log.Printf("⚠️  WARNING: Both processors are down, keeping current: %s", h.HealthyProcessor.Service)
-	h.storeHealthStatusInRedis(h.HealthyProcessor.Service)
+	// log.Printf("⚠️  WARNING: All processors are down, keeping current: %s", current.Service)
+	h.storeHealthStatus(current.Service)
 	// log.Printf("=== End health check cycle ===")
 }
 
-func (h *HealthCheckService) storeHealthStatusInRedis(service string) {
+func (h *HealthCheckService) storeHealthStatus(service string) {
 	ctx := context.Background()
-	healthData := map[string]any{
-		"service":   service,
-		"timestamp": time.Now().Unix(),
-	}
-
-	err := h.store.RedisClient.HMSet(ctx, "healthy_processor_status", healthData).Err()
+	err := h.store.SetHealthyProcessor(ctx, service)
 	if err != nil {
 		// log.Printf("❌ Failed to store health status in Redis: %v", err)
 	} else {
@@ -153,37 +185,23 @@ func (h *HealthCheckService) storeHealthStatusInRedis(service string) {
 	}
 }
 
-func (h *HealthCheckService) readHealthStatusFromRedis() {
+func (h *HealthCheckService) readHealthStatus() {
 	ctx := context.Background()
-	result := h.store.RedisClient.HGetAll(ctx, "healthy_processor_status")
-
-	healthData, err := result.Result()
+	service, err := h.store.GetHealthyProcessor(ctx)
 	if err != nil {
 		// log.Printf("❌ Failed to read health status from Redis: %v", err)
 		return
 	}
 
-	if len(healthData) == 0 {
-		// log.Printf("📖 No health status found in Redis, keeping current: %s", h.HealthyProcessor.Service)
+	if service == "" {
+		// log.Printf("📖 No health status found in Redis, keeping current")
 		return
 	}
 
-	service := healthData["service"]
-	// timestamp := healthData["timestamp"]
-
-	// log.Printf("📖 Read health status from Redis: service=%s, timestamp=%s", service, timestamp)
+	// log.Printf("📖 Read health status from Redis: service=%s", service)
 
-	if service == "default" && h.HealthyProcessor.Service != "default" {
-		// log.Printf("🔄 Updating to main processor based on Redis status")
-		h.HealthyProcessor = &PaymentProcessorDestination{
-			URL:     DEFAULT_PAYMENT_PROCESSOR_URL,
-			Service: "default",
-		}
-	} else if service == "fallback" && h.HealthyProcessor.Service != "fallback" {
-		// log.Printf("🔄 Updating to fallback processor based on Redis status")
-		h.HealthyProcessor = &PaymentProcessorDestination{
-			URL:     FALLBACK_PAYMENT_PROCESSOR_URL,
-			Service: "fallback",
-		}
+	if destination := h.Destination(service); destination != nil && destination != h.HealthyProcessor() {
+		// log.Printf("🔄 Updating to %s processor based on Redis status", service)
+		h.healthyProcessor.Store(destination)
 	}
 }
@@ -0,0 +1,200 @@
+package health
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"rinha-backend-arthur/internal/store"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// processorStandIn answers health checks like a payment processor, failing while failing is set.
+func processorStandIn(t *testing.T, failing *atomic.Bool) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/payments/service-health" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintf(w, `{"failing":%t,"minResponseTime":0}`, failing.Load())
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func destination(service string, server *httptest.Server, fee float64) PaymentProcessorDestination {
+	return PaymentProcessorDestination{
+		Service:      service,
+		BaseURL:      server.URL,
+		PaymentsPath: "/payments",
+		HealthPath:   "/payments/service-health",
+		Timeout:      time.Second,
+		Fee:          fee,
+	}
+}
+
+func TestHealthCheckPrefersTheCheapestHealthyProcessor(t *testing.T) {
+	var defaultFailing, fallbackFailing atomic.Bool
+	defaultServer := processorStandIn(t, &defaultFailing)
+	fallbackServer := processorStandIn(t, &fallbackFailing)
+
+	paymentStore := store.NewMemoryStore()
+	h := NewHealthCheckService(paymentStore, []PaymentProcessorDestination{
+		destination("default", defaultServer, 0.15),
+		destination("fallback", fallbackServer, 0.05),
+	})
+	if got := h.HealthyProcessor().Service; got != "fallback" {
+		t.Fatalf("starts on %s, want the cheaper fallback", got)
+	}
+
+	fallbackFailing.Store(true)
+	h.updateHealthyProcessor()
+	if got := h.HealthyProcessor().Service; got != "default" {
+		t.Fatalf("with fallback failing uses %s, want default", got)
+	}
+	if service, _ := paymentStore.GetHealthyProcessor(context.Background()); service != "default" {
+		t.Fatalf("stored healthy processor = %q, want default", service)
+	}
+
+	// All are down, the current one is kept
+	defaultFailing.Store(true)
+	h.updateHealthyProcessor()
+	if got := h.HealthyProcessor().Service; got != "default" {
+		t.Fatalf("with all failing uses %s, want default kept", got)
+	}
+
+	fallbackFailing.Store(false)
+	h.updateHealthyProcessor()
+	if got := h.HealthyProcessor().Service; got != "fallback" {
+		t.Fatalf("after fallback recovered uses %s, want fallback", got)
+	}
+}
+
+func TestHealthCheckTreatsUnreachableProcessorsAsFailing(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		fmt.Fprint(w, `{"failing":false,"minResponseTime":0}`)
+	}))
+	defer slow.Close()
+	garbled := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `<html>`)
+	}))
+	defer garbled.Close()
+
+	slowDestination := destination("default", slow, 0)
+	slowDestination.Timeout = 20 * time.Millisecond
+	garbledDestination := destination("fallback", garbled, 0)
+
+	h := NewHealthCheckService(store.NewMemoryStore(), nil)
+	if h.isHealthy(&slowDestination) {
+		t.Fatal("a processor answering after the timeout is healthy")
+	}
+	if h.isHealthy(&garbledDestination) {
+		t.Fatal("a processor answering garbage is healthy")
+	}
+}
+
+func TestReadHealthStatusFollowsOtherReplicas(t *testing.T) {
+	var failing atomic.Bool
+	server := processorStandIn(t, &failing)
+
+	paymentStore := store.NewMemoryStore()
+	h := NewHealthCheckService(paymentStore, []PaymentProcessorDestination{
+		destination("default", server, 0.05),
+		destination("fallback", server, 0.15),
+	})
+
+	paymentStore.SetHealthyProcessor(context.Background(), "fallback")
+	h.readHealthStatus()
+	if got := h.HealthyProcessor().Service; got != "fallback" {
+		t.Fatalf("after reading the stored status uses %s, want fallback", got)
+	}
+
+	// An unknown service leaves the current destination alone
+	paymentStore.SetHealthyProcessor(context.Background(), "unknown")
+	h.readHealthStatus()
+	if got := h.HealthyProcessor().Service; got != "fallback" {
+		t.Fatalf("after reading an unknown service uses %s, want fallback", got)
+	}
+}
+
+func TestHealthCheckWithoutDestinations(t *testing.T) {
+	paymentStore := store.NewMemoryStore()
+	h := NewHealthCheckService(paymentStore, nil)
+	if h.HealthyProcessor() != nil {
+		t.Fatal("HealthyProcessor without destinations is not nil")
+	}
+
+	h.updateHealthyProcessor()
+	paymentStore.SetHealthyProcessor(context.Background(), "default")
+	h.readHealthStatus()
+	if h.HealthyProcessor() != nil {
+		t.Fatal("HealthyProcessor without destinations is not nil after a check")
+	}
+}
+
+func TestHealthCheckLoopStopsWithContext(t *testing.T) {
+	h := NewHealthCheckService(store.NewMemoryStore(), nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		h.StartHealthCheckLoop(ctx)
+		close(stopped)
+	}()
+
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("health check loop still running after ctx was cancelled")
+	}
+}
+
+// Run with -race: workers read the healthy processor while the health check replaces it.
+func TestHealthyProcessorConcurrentAccess(t *testing.T) {
+	var failing, fallbackFailing atomic.Bool
+	server := processorStandIn(t, &failing)
+	fallbackServer := processorStandIn(t, &fallbackFailing)
+
+	paymentStore := store.NewMemoryStore()
+	h := NewHealthCheckService(paymentStore, []PaymentProcessorDestination{
+		destination("default", server, 0.05),
+		destination("fallback", fallbackServer, 0.15),
+	})
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+					if h.HealthyProcessor() == nil {
+						t.Error("HealthyProcessor is nil")
+						return
+					}
+					runtime.Gosched()
+				}
+			}
+		}()
+	}
+
+	// The default processor flaps, the healthy processor switches on every check
+	for i := range 20 {
+		failing.Store(i%2 == 0)
+		h.updateHealthyProcessor()
+		paymentStore.SetHealthyProcessor(context.Background(), "default")
+		h.readHealthStatus()
+	}
+	close(done)
+	wg.Wait()
+}
@@ -0,0 +1,150 @@
+package keyspace
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Keyspace names the Redis keys of one deployment. Every key starts with the prefix
+// wrapped in a hash tag, "{prefix}:", so deployments can share a Redis and all keys of
+// one deployment hash to the same cluster slot, which multi-key scripts, transactions
+// and pipelines such as the settle script or the summary reads need.
+type Keyspace struct {
+	prefix string
+}
+
+func New(prefix string) Keyspace {
+	return Keyspace{prefix: "{" + prefix + "}:"}
+}
+
+// Key joins parts with ':' under the deployment prefix.
+func (k Keyspace) Key(parts ...string) string {
+	return k.prefix + strings.Join(parts, ":")
+}
+
+// Match is a SCAN pattern for every key starting with Key(parts...).
+func (k Keyspace) Match(parts ...string) string {
+	return escapeGlob(k.Key(parts...)) + "*"
+}
+
+var globEscaper = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`)
+
+func escapeGlob(s string) string {
+	return globEscaper.Replace(s)
+}
+
+// Scan calls fn with every key matching match. A cluster is scanned master by master,
+// SCAN on a cluster client only reaches one node.
+func Scan(ctx context.Context, client redis.UniversalClient, match string, fn func(key string) error) error {
+	if cluster, ok := client.(*redis.ClusterClient); ok {
+		return cluster.ForEachMaster(ctx, func(ctx context.Context, node *redis.Client) error {
+			return scanNode(ctx, node, match, fn)
+		})
+	}
+	return scanNode(ctx, client, match, fn)
+}
+
+func scanNode(ctx context.Context, client redis.Cmdable, match string, fn func(key string) error) error {
+	iter := client.Scan(ctx, 0, match, 1000).Iterator()
+	for iter.Next(ctx) {
+		if err := fn(iter.Val()); err != nil {
+			return err
+		}
+	}
+	return iter.Err()
+}
+
+// Delete removes every key matching match. It walks the keyspace with SCAN, so Redis
+// is never blocked the way KEYS would, and returns how many keys it removed.
+func Delete(ctx context.Context, client redis.UniversalClient, match string) (int64, error) {
+	var deleted int64
+	batch := make([]string, 0, 500)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		n, err := client.Unlink(ctx, batch...).Result()
+		deleted += n
+		batch = batch[:0]
+		return err
+	}
+
+	err := Scan(ctx, client, match, func(key string) error {
+		batch = append(batch, key)
+		if len(batch) == cap(batch) {
+			return flush()
+		}
+		return nil
+	})
+	if err != nil {
+		return deleted, err
+	}
+
+	return deleted, flush()
+}
+
+// ErrKeyExists is returned by Adopt when the key it would rename onto is already written.
+var ErrKeyExists = errors.New("key already exists")
+
+// Adopt renames legacy, a key written before keys had a prefix, to key. It returns false
+// when there is no legacy key, and ErrKeyExists, leaving both keys alone, when key exists.
+// Legacy keys come from standalone deployments, on a cluster the rename fails with CROSSSLOT.
+func Adopt(ctx context.Context, client redis.UniversalClient, legacy, key string) (bool, error) {
+	n, err := client.Exists(ctx, legacy).Result()
+	if err != nil || n == 0 {
+		return false, err
+	}
+
+	renamed, err := client.RenameNX(ctx, legacy, key).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to rename %s to %s: %w", legacy, key, err)
+	}
+	if !renamed {
+		return false, fmt.Errorf("%w: left %s in place of %s", ErrKeyExists, legacy, key)
+	}
+	return true, nil
+}
+
+// AdoptAll adopts every legacy key of renames, mapped to its new name, and returns how many it
+// moved. Keys it has to leave in place don't stop it, they are joined in the returned error.
+func AdoptAll(ctx context.Context, client redis.UniversalClient, renames map[string]string) (int, error) {
+	var adopted int
+	var conflicts []error
+	for legacy, key := range renames {
+		moved, err := Adopt(ctx, client, legacy, key)
+		if errors.Is(err, ErrKeyExists) {
+			conflicts = append(conflicts, err)
+			continue
+		}
+		if err != nil {
+			return adopted, err
+		}
+		if moved {
+			adopted++
+		}
+	}
+	return adopted, errors.Join(conflicts...)
+}
+
+// AdoptMatching is AdoptAll for the legacy keys matching match, renamed by rename.
+func AdoptMatching(ctx context.Context, client redis.UniversalClient, match string, rename func(legacy string) string) (int, error) {
+	var adopted int
+	var conflicts []error
+	err := Scan(ctx, client, match, func(legacy string) error {
+		n, err := AdoptAll(ctx, client, map[string]string{legacy: rename(legacy)})
+		adopted += n
+		if errors.Is(err, ErrKeyExists) {
+			conflicts = append(conflicts, err)
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return adopted, err
+	}
+	return adopted, errors.Join(conflicts...)
+}
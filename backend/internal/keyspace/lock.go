@@ -0,0 +1,33 @@
+package keyspace
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+// releaseLockScript deletes a lock only while it still holds the caller's token, so a holder
+// whose lock expired can't release the lock another replica took since.
+var releaseLockScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// AcquireLock takes the lock at key for ttl. It returns the token that releases it, empty
+// when someone else holds the lock.
+func AcquireLock(ctx context.Context, client redis.UniversalClient, key string, ttl time.Duration) (string, error) {
+	token := uuid.NewString()
+	acquired, err := client.SetNX(ctx, key, token, ttl).Result()
+	if err != nil || !acquired {
+		return "", err
+	}
+	return token, nil
+}
+
+func ReleaseLock(ctx context.Context, client redis.UniversalClient, key string, token string) error {
+	return releaseLockScript.Run(ctx, client, []string{key}, token).Err()
+}
@@ -0,0 +1,87 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"rinha-backend-arthur/internal/keyspace"
+	"rinha-backend-arthur/internal/queue"
+	"rinha-backend-arthur/internal/store"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RunMigration moves the keys written before keys had a prefix into the deployment keyspace,
+// rewrites the stored payment records in the current record version, then backfills the summary
+// aggregates of stores that keep them. Coming from a version without the prefix, run it after
+// stopping the old replicas and before starting new ones: a legacy key whose new name is written
+// already is left in place and reported. Otherwise it is safe to run while the API is serving,
+// and to run again after a failure.
+func RunMigration(config Config) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	redisClient, err := newRedisClient(config)
+	if err != nil {
+		return err
+	}
+	defer redisClient.Close()
+
+	initCtx, cancelInit := context.WithTimeout(ctx, 5*time.Second)
+	defer cancelInit()
+
+	paymentStore := newStore(ctx, initCtx, config, redisClient, nil) // Nothing is enqueued or acked while migrating
+
+	start := time.Now()
+	adopted, err := adoptLegacyKeys(ctx, config, redisClient, paymentStore)
+	fmt.Printf("Moved %d legacy keys into the %s keyspace in %v\n", adopted, config.RedisKeyPrefix, time.Since(start))
+	if err != nil {
+		return err
+	}
+
+	migrator, ok := paymentStore.(store.RecordMigrator)
+	if !ok {
+		return fmt.Errorf("the %s store has no records to migrate", config.StoreBackend)
+	}
+
+	start = time.Now()
+	result, err := migrator.MigrateRecords(ctx, config.MigrationBatchSize)
+	fmt.Printf("Scanned %d payment records, migrated %d, skipped %d in %v\n", result.Scanned, result.Migrated, result.Skipped, time.Since(start))
+	if err != nil {
+		return err
+	}
+
+	if backfiller, ok := paymentStore.(store.SummaryBackfiller); ok {
+		start = time.Now()
+		buckets, err := backfiller.BackfillSummaries(ctx)
+		fmt.Printf("Backfilled %d summary buckets in %v\n", buckets, time.Since(start))
+		return err
+	}
+	return nil
+}
+
+func adoptLegacyKeys(ctx context.Context, config Config, redisClient redis.UniversalClient, paymentStore store.Store) (int, error) {
+	adopted, err := queue.AdoptLegacyKeys(ctx, redisClient, keyspace.New(config.RedisKeyPrefix))
+	if err := reportLeftInPlace(err); err != nil {
+		return adopted, err
+	}
+
+	if adopter, ok := paymentStore.(store.LegacyKeyAdopter); ok {
+		storeKeys, err := adopter.AdoptLegacyKeys(ctx)
+		adopted += storeKeys
+		if err := reportLeftInPlace(err); err != nil {
+			return adopted, err
+		}
+	}
+	return adopted, nil
+}
+
+// reportLeftInPlace prints the legacy keys whose new names were taken, they don't fail the migration.
+func reportLeftInPlace(err error) error {
+	if errors.Is(err, keyspace.ErrKeyExists) {
+		fmt.Printf("Legacy keys left in place: %v\n", err)
+		return nil
+	}
+	return err
+}
@@ -1,13 +1,14 @@
 package models
 
 import (
+	"encoding/json"
 	"time"
 
 	"github.com/google/uuid"
 )
 
 type PaymentRequest struct {
-	Amount        int64     `json:"amount"`
+	Amount        Money     `json:"amount"`
 	CorrelationId uuid.UUID `json:"correlationId"`
 	RequestedAt   time.Time `json:"requestedAt"` // Add this field!
 }
@@ -28,16 +29,99 @@ type PaymentSummaryResponse struct {
 }
 
 type SummaryResponse struct {
-	TotalAmount   float64 `json:"totalAmount"`
-	TotalRequests int64   `json:"totalRequests"`
+	TotalAmount   Money `json:"totalAmount"`
+	TotalRequests int64 `json:"totalRequests"`
 }
 
 type Summary struct {
 	TotalRequests int64 `json:"totalRequests"`
-	TotalAmount   int64 `json:"totalAmount"`
+	TotalAmount   Money `json:"totalAmount"`
 }
 
 type HealthCheckResponse struct {
 	MinResponseTime uint16 `json:"minResponseTime"`
 	Failing         bool   `json:"failing"`
 }
+
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+type ErrorResponse struct {
+	Error  string       `json:"error"`
+	Fields []FieldError `json:"fields,omitempty"`
+}
+
+type PaymentStatus string
+
+const (
+	PaymentStatusQueued       PaymentStatus = "queued"
+	PaymentStatusProcessing   PaymentStatus = "processing"
+	PaymentStatusProcessed    PaymentStatus = "processed"
+	PaymentStatusRetrying     PaymentStatus = "retrying"
+	PaymentStatusDeadLettered PaymentStatus = "dead_lettered"
+)
+
+type PaymentTransition struct {
+	Status    PaymentStatus `json:"status"`
+	At        time.Time     `json:"at"`
+	Worker    *int          `json:"worker,omitempty"`
+	Processor string        `json:"processor,omitempty"`
+	Attempt   int           `json:"attempt,omitempty"`
+	Error     string        `json:"error,omitempty"`
+	RetryAt   *time.Time    `json:"retryAt,omitempty"`
+}
+
+type PaymentStatusResponse struct {
+	CorrelationId uuid.UUID           `json:"correlationId"`
+	Status        PaymentStatus       `json:"status"`
+	Worker        *int                `json:"worker,omitempty"`
+	Processor     string              `json:"processor,omitempty"`
+	Attempts      int                 `json:"attempts"`
+	Transitions   []PaymentTransition `json:"transitions"`
+}
+
+// QueueMessage is the envelope stored in the payments queue.
+type QueueMessage struct {
+	CorrelationId uuid.UUID       `json:"correlationId"`
+	Payload       json.RawMessage `json:"payload"`
+	Attempts      int             `json:"attempts"`
+	LastError     string          `json:"lastError,omitempty"`
+	// AmbiguousProcessor is the processor that may have charged the payment after a
+	// timeout or dropped connection. It has to be asked before the payment is sent again.
+	AmbiguousProcessor string `json:"ambiguousProcessor,omitempty"`
+}
+
+type DeadLetterListResponse struct {
+	Total   int64          `json:"total"`
+	Entries []QueueMessage `json:"entries"`
+}
+
+// PaymentExportRecord is one line of the NDJSON ledger export.
+type PaymentExportRecord struct {
+	CorrelationId uuid.UUID `json:"correlationId"`
+	Amount        Money     `json:"amount"`
+	RequestedAt   time.Time `json:"requestedAt"`
+	Processor     string    `json:"processor"`
+}
+
+type MetricsResponse struct {
+	Queue           QueueMetrics     `json:"queue"`
+	ProcessorErrors map[string]int64 `json:"processorErrors"`
+	OutboxBacklog   int              `json:"outboxBacklog"` // this instance only, the outbox is a local file
+}
+
+// HealthResponse is degraded while payments accepted by a processor are still waiting in the outbox.
+type HealthResponse struct {
+	Status           string `json:"status"` // ok or degraded
+	HealthyProcessor string `json:"healthyProcessor"`
+	OutboxBacklog    int    `json:"outboxBacklog"`
+}
+
+type QueueMetrics struct {
+	Queued       int64 `json:"queued"`
+	Processing   int64 `json:"processing"`
+	Retrying     int64 `json:"retrying"`
+	DeadLettered int64 `json:"deadLettered"`
+}
@@ -0,0 +1,104 @@
+package models
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"math/big"
+	"regexp"
+	"strconv"
+)
+
+// Money is an amount in integer cents. It reads and writes JSON as a decimal number
+// ("19.90") without ever going through float64, so 19.90 is always 1990 cents.
+type Money int64
+
+// jsonNumber is the JSON number grammar, big.Rat alone would also take fractions and base prefixes.
+var jsonNumber = regexp.MustCompile(`^-?(0|[1-9][0-9]*)(\.[0-9]+)?([eE]([+-]?[0-9]+))?$`)
+
+// maxExponent keeps absurd exponents from making big.Rat allocate huge numbers.
+const maxExponent = 40
+
+var (
+	hundred  = big.NewInt(100)
+	maxMoney = big.NewInt(math.MaxInt64)
+	minMoney = big.NewInt(math.MinInt64)
+)
+
+// ParseMoney parses a decimal literal, JSON exponents included, into cents.
+// Fractions of a cent are rounded half away from zero.
+func ParseMoney(s string) (Money, error) {
+	match := jsonNumber.FindStringSubmatch(s)
+	if match == nil {
+		return 0, fmt.Errorf("invalid amount %q", s)
+	}
+	if match[4] != "" {
+		exponent, err := strconv.Atoi(match[4])
+		if err != nil || exponent > maxExponent || exponent < -maxExponent {
+			return 0, fmt.Errorf("amount %q out of range", s)
+		}
+	}
+
+	value, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return 0, fmt.Errorf("invalid amount %q", s)
+	}
+
+	value.Mul(value, new(big.Rat).SetInt(hundred))
+
+	quotient, remainder := new(big.Int).QuoRem(value.Num(), value.Denom(), new(big.Int))
+	// |remainder| / denom >= 1/2 rounds away from zero
+	if remainder.Sign() != 0 {
+		doubled := new(big.Int).Mul(new(big.Int).Abs(remainder), big.NewInt(2))
+		if doubled.Cmp(value.Denom()) >= 0 {
+			quotient.Add(quotient, big.NewInt(int64(value.Sign())))
+		}
+	}
+
+	if quotient.Cmp(maxMoney) > 0 || quotient.Cmp(minMoney) < 0 {
+		return 0, fmt.Errorf("amount %q out of range", s)
+	}
+
+	return Money(quotient.Int64()), nil
+}
+
+func (m Money) Cents() int64 {
+	return int64(m)
+}
+
+func (m Money) Float64() float64 {
+	return float64(m) / 100.0
+}
+
+// String formats the amount with exactly two decimal places.
+func (m Money) String() string {
+	cents := int64(m)
+	sign := ""
+	if cents < 0 {
+		sign = "-"
+	}
+
+	abs := new(big.Int).Abs(big.NewInt(cents))
+	units, fraction := new(big.Int).QuoRem(abs, hundred, new(big.Int))
+
+	return fmt.Sprintf("%s%s.%02d", sign, units.String(), fraction.Int64())
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+func (m *Money) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if bytes.Equal(data, []byte("null")) {
+		return nil
+	}
+
+	parsed, err := ParseMoney(string(data))
+	if err != nil {
+		return err
+	}
+
+	*m = parsed
+	return nil
+}
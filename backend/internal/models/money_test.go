@@ -0,0 +1,126 @@
+package models
+
+import (
+	"encoding/json"
+	"math"
+	"math/rand/v2"
+	"strconv"
+	"testing"
+)
+
+// randomCents covers small amounts, whole int64 range and the bounds themselves.
+func randomCents(r *rand.Rand) Money {
+	switch r.IntN(4) {
+	case 0:
+		return Money(r.Int64N(1_000_000) - 500_000)
+	case 1:
+		return Money(math.MaxInt64 - r.Int64N(1000))
+	case 2:
+		return Money(math.MinInt64 + r.Int64N(1000))
+	default:
+		return Money(int64(r.Uint64()))
+	}
+}
+
+func TestMoneyStringRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewPCG(1, 2))
+	for range 10000 {
+		m := randomCents(r)
+		parsed, err := ParseMoney(m.String())
+		if err != nil || parsed != m {
+			t.Fatalf("ParseMoney(%q) = %d, %v, want %d", m.String(), parsed, err, m)
+		}
+	}
+}
+
+func TestMoneyJSONRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewPCG(3, 4))
+	for range 10000 {
+		m := randomCents(r)
+		data, err := json.Marshal(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded Money
+		if err := json.Unmarshal(data, &decoded); err != nil || decoded != m {
+			t.Fatalf("Unmarshal(%s) = %d, %v, want %d", data, decoded, err, m)
+		}
+	}
+}
+
+func TestParseMoneyRoundsHalfAwayFromZero(t *testing.T) {
+	r := rand.New(rand.NewPCG(5, 6))
+	for range 10000 {
+		m := Money(r.Int64N(2_000_000) - 1_000_000)
+		if m == 0 {
+			continue
+		}
+		digit := r.IntN(10)
+		literal := m.String() + strconv.Itoa(digit)
+
+		want := m
+		if digit >= 5 {
+			if m > 0 {
+				want++
+			} else {
+				want--
+			}
+		}
+
+		got, err := ParseMoney(literal)
+		if err != nil || got != want {
+			t.Fatalf("ParseMoney(%q) = %d, %v, want %d", literal, got, err, want)
+		}
+	}
+}
+
+func TestParseMoneyExponents(t *testing.T) {
+	r := rand.New(rand.NewPCG(7, 8))
+	for range 10000 {
+		m := Money(r.Int64N(1_000_000_000))
+		// 1234.56 == 123456e-2 == 0.123456e4
+		for _, literal := range []string{
+			strconv.FormatInt(m.Cents(), 10) + "e-2",
+			"0." + strconv.FormatInt(m.Cents()+1_000_000_000, 10)[1:] + "e7",
+		} {
+			got, err := ParseMoney(literal)
+			if err != nil || got != m {
+				t.Fatalf("ParseMoney(%q) = %d, %v, want %d", literal, got, err, m)
+			}
+		}
+	}
+}
+
+func TestParseMoneyBounds(t *testing.T) {
+	tests := []struct {
+		literal string
+		want    Money
+		ok      bool
+	}{
+		{"92233720368547758.07", math.MaxInt64, true},
+		{"92233720368547758.08", 0, false},
+		{"92233720368547758.074", math.MaxInt64, true},
+		{"92233720368547758.075", 0, false},
+		{"-92233720368547758.08", math.MinInt64, true},
+		{"-92233720368547758.09", 0, false},
+		{"1e16", 1_000_000_000_000_000_000, true},
+		{"1e17", 0, false},
+		{"1e40", 0, false},
+		{"1e50", 0, false},
+		{"1e-41", 0, false},
+		{"1e-40", 0, true},
+		{"0.004", 0, true},
+		{"0.005", 1, true},
+		{"01", 0, false},
+		{"1/2", 0, false},
+		{"0x10", 0, false},
+		{"", 0, false},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseMoney(tt.literal)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("ParseMoney(%q) = %d, %v, want %d (ok=%v)", tt.literal, got, err, tt.want, tt.ok)
+		}
+	}
+}
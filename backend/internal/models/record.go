@@ -0,0 +1,189 @@
+package models
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// A payment record is the stored form of a settled payment. Version 1, the current one, is 34 bytes:
+//
+//	version (1) | correlationId (16) | amount in cents (8) | requestedAt in unix nanoseconds (8) | processor id (1)
+//
+// Integers are big-endian. Version 0 is the JSON map written before binary records, tagged with
+// its version byte like any other. Records stored before version bytes existed are that JSON
+// alone and are read as version 0 too, which is why no version may ever be '{'. A new layout gets
+// a new version byte, and DecodePaymentRecord keeps reading the old ones so a store can hold a mix
+// while it is migrated.
+const (
+	PaymentRecordV0   byte = 0
+	PaymentRecordV1   byte = 1
+	PaymentRecordSize      = 1 + 16 + 8 + 8 + 1
+
+	// CurrentPaymentRecordVersion is what EncodePaymentRecord writes
+	CurrentPaymentRecordVersion = PaymentRecordV1
+)
+
+// Processor ids used in payment records
+const (
+	ProcessorIDDefault  byte = 1
+	ProcessorIDFallback byte = 2
+)
+
+var ErrInvalidPaymentRecord = errors.New("invalid payment record")
+
+// legacyTimestamp is the RFC 3339 grammar version 0 requestedAt values are held to. time.Parse
+// alone also takes single-digit hours, comma fractions and offsets like +24:00 or +05:60.
+var legacyTimestamp = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}(\.\d+)?(Z|[+-]([01]\d|2[0-3]):[0-5]\d)$`)
+
+// maxLegacyAmount is the largest JSON amount that is still an exact integer as a float64.
+const maxLegacyAmount = 1 << 53
+
+func ProcessorID(service string) (byte, bool) {
+	switch service {
+	case "default":
+		return ProcessorIDDefault, true
+	case "fallback":
+		return ProcessorIDFallback, true
+	}
+	return 0, false
+}
+
+func ProcessorName(id byte) (string, bool) {
+	switch id {
+	case ProcessorIDDefault:
+		return "default", true
+	case ProcessorIDFallback:
+		return "fallback", true
+	}
+	return "", false
+}
+
+// EncodePaymentRecord encodes a settled payment in the current record version.
+func EncodePaymentRecord(payment Payment) ([]byte, error) {
+	processorID, ok := ProcessorID(payment.Service)
+	if !ok {
+		return nil, fmt.Errorf("unknown payment processor %q", payment.Service)
+	}
+
+	record := make([]byte, 0, PaymentRecordSize)
+	record = append(record, PaymentRecordV1)
+	record = append(record, payment.CorrelationId[:]...)
+	record = binary.BigEndian.AppendUint64(record, uint64(payment.Amount.Cents()))
+	record = binary.BigEndian.AppendUint64(record, uint64(payment.RequestedAt.UnixNano()))
+	record = append(record, processorID)
+
+	return record, nil
+}
+
+// PaymentRecordVersion tells which layout a stored record uses.
+func PaymentRecordVersion(record []byte) (byte, error) {
+	if len(record) == 0 {
+		return 0, ErrInvalidPaymentRecord
+	}
+	switch record[0] {
+	case PaymentRecordV0, '{':
+		return PaymentRecordV0, nil
+	case PaymentRecordV1:
+		return PaymentRecordV1, nil
+	}
+	return 0, ErrInvalidPaymentRecord
+}
+
+// DecodePaymentRecord reads a record of any version.
+func DecodePaymentRecord(record []byte) (Payment, error) {
+	version, err := PaymentRecordVersion(record)
+	if err != nil {
+		return Payment{}, err
+	}
+
+	if version == PaymentRecordV0 {
+		if record[0] == PaymentRecordV0 {
+			record = record[1:]
+		}
+		if len(record) == 0 || record[0] != '{' {
+			return Payment{}, ErrInvalidPaymentRecord
+		}
+		return decodePaymentRecordV0(record)
+	}
+	return decodePaymentRecordV1(record)
+}
+
+func decodePaymentRecordV1(record []byte) (Payment, error) {
+	if len(record) != PaymentRecordSize {
+		return Payment{}, ErrInvalidPaymentRecord
+	}
+
+	service, ok := ProcessorName(record[33])
+	if !ok {
+		return Payment{}, ErrInvalidPaymentRecord
+	}
+
+	var payment Payment
+	copy(payment.CorrelationId[:], record[1:17])
+	payment.Amount = Money(int64(binary.BigEndian.Uint64(record[17:25])))
+	payment.RequestedAt = time.Unix(0, int64(binary.BigEndian.Uint64(record[25:33]))).UTC()
+	payment.Service = service
+
+	return payment, nil
+}
+
+// decodePaymentRecordV0 reads the JSON map. Amounts are cents, but older writers left them as
+// JSON floats, so they are rounded.
+func decodePaymentRecordV0(record []byte) (Payment, error) {
+	var data map[string]interface{}
+	if err := json.Unmarshal(record, &data); err != nil {
+		return Payment{}, fmt.Errorf("%w: %v", ErrInvalidPaymentRecord, err)
+	}
+
+	correlationIdStr, ok := data["correlationId"].(string)
+	if !ok {
+		return Payment{}, fmt.Errorf("%w: invalid correlationId", ErrInvalidPaymentRecord)
+	}
+
+	amount, ok := data["amount"].(float64)
+	if !ok {
+		return Payment{}, fmt.Errorf("%w: invalid amount type: %T", ErrInvalidPaymentRecord, data["amount"])
+	}
+	if math.Abs(amount) > maxLegacyAmount {
+		return Payment{}, fmt.Errorf("%w: amount out of range", ErrInvalidPaymentRecord)
+	}
+
+	service, ok := data["paymentProcessor"].(string)
+	if !ok {
+		return Payment{}, fmt.Errorf("%w: invalid paymentProcessor", ErrInvalidPaymentRecord)
+	}
+
+	requestedAtStr, ok := data["requestedAt"].(string)
+	if !ok {
+		return Payment{}, fmt.Errorf("%w: invalid requestedAt", ErrInvalidPaymentRecord)
+	}
+
+	correlationId, err := uuid.Parse(correlationIdStr)
+	if err != nil {
+		return Payment{}, fmt.Errorf("%w: failed to parse correlationId: %v", ErrInvalidPaymentRecord, err)
+	}
+
+	if !legacyTimestamp.MatchString(requestedAtStr) {
+		return Payment{}, fmt.Errorf("%w: invalid requestedAt %q", ErrInvalidPaymentRecord, requestedAtStr)
+	}
+	requestedAt, err := time.Parse(time.RFC3339Nano, requestedAtStr)
+	if err != nil {
+		return Payment{}, fmt.Errorf("%w: failed to parse requestedAt: %v", ErrInvalidPaymentRecord, err)
+	}
+
+	return Payment{
+		PaymentRequest: PaymentRequest{
+			CorrelationId: correlationId,
+			Amount:        Money(int64(math.Round(amount))),
+			RequestedAt:   requestedAt.UTC(),
+		},
+		Service: service,
+	}, nil
+}
@@ -0,0 +1,266 @@
+package outbox
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"rinha-backend-arthur/internal/models"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Outbox keeps payments the processor accepted but the store failed to record, in an
+// append-only file on local disk, until a flush manages to store them. Each replica has its own.
+type Outbox struct {
+	path string
+
+	mu      sync.Mutex
+	file    *os.File
+	pending []models.Payment
+}
+
+type record struct {
+	CorrelationId uuid.UUID    `json:"correlationId"`
+	Amount        models.Money `json:"amount"`
+	RequestedAt   time.Time    `json:"requestedAt"`
+	Service       string       `json:"service"`
+}
+
+// Open loads the payments left in the file by a previous run. When the file can't be
+// opened the returned outbox still works, but only in memory.
+func Open(path string) (*Outbox, error) {
+	o := &Outbox{path: path}
+
+	torn, err := o.load()
+	if err != nil {
+		return o, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return o, fmt.Errorf("failed to create outbox directory: %w", err)
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return o, fmt.Errorf("failed to open outbox: %w", err)
+	}
+	o.file = file
+
+	if torn {
+		// The next append would continue the torn line and be lost with it
+		if err := o.rewrite(); err != nil {
+			return o, err
+		}
+	}
+
+	return o, nil
+}
+
+// load reads the pending payments and reports whether the file ends in a line torn by a
+// crash mid-write.
+func (o *Outbox) load() (bool, error) {
+	data, err := os.ReadFile(o.path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to read outbox: %w", err)
+	}
+
+	seen := make(map[uuid.UUID]bool)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		var r record
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			continue // Skip a line torn by a crash mid-write
+		}
+		if seen[r.CorrelationId] {
+			continue
+		}
+		seen[r.CorrelationId] = true
+		o.pending = append(o.pending, r.payment())
+	}
+
+	torn := len(data) > 0 && data[len(data)-1] != '\n'
+	return torn, scanner.Err()
+}
+
+func newRecord(payment models.Payment) record {
+	return record{
+		CorrelationId: payment.CorrelationId,
+		Amount:        payment.Amount,
+		RequestedAt:   payment.RequestedAt,
+		Service:       payment.Service,
+	}
+}
+
+func (r record) payment() models.Payment {
+	return models.Payment{
+		PaymentRequest: models.PaymentRequest{
+			CorrelationId: r.CorrelationId,
+			Amount:        r.Amount,
+			RequestedAt:   r.RequestedAt,
+		},
+		Service: r.Service,
+	}
+}
+
+// Append durably adds a payment. It returns once the line is synced to disk.
+func (o *Outbox) Append(payment models.Payment) error {
+	line, err := json.Marshal(newRecord(payment))
+	if err != nil {
+		return fmt.Errorf("failed to marshal outbox record: %w", err)
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.pending = append(o.pending, payment)
+
+	if o.file == nil {
+		return nil
+	}
+	if _, err := o.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to append to outbox: %w", err)
+	}
+	if err := o.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync outbox: %w", err)
+	}
+
+	return nil
+}
+
+// Backlog returns how many payments are waiting to be stored.
+func (o *Outbox) Backlog() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return len(o.pending)
+}
+
+// Flush tries to store every pending payment and rewrites the file with the ones that failed.
+// It returns how many payments were stored.
+func (o *Outbox) Flush(ctx context.Context, store func(context.Context, models.Payment) error) (int, error) {
+	o.mu.Lock()
+	pending := append([]models.Payment(nil), o.pending...)
+	o.mu.Unlock()
+
+	if len(pending) == 0 {
+		return 0, nil
+	}
+
+	stored := make(map[uuid.UUID]bool)
+	var storeErr error
+	for _, payment := range pending {
+		if err := store(ctx, payment); err != nil {
+			storeErr = err
+			break // The store is most likely still down, try again on the next flush
+		}
+		stored[payment.CorrelationId] = true
+	}
+
+	if len(stored) == 0 {
+		return 0, storeErr
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	remaining := o.pending[:0]
+	for _, payment := range o.pending {
+		if !stored[payment.CorrelationId] {
+			remaining = append(remaining, payment)
+		}
+	}
+	o.pending = remaining
+
+	if err := o.rewrite(); err != nil {
+		return len(stored), err
+	}
+
+	return len(stored), storeErr
+}
+
+// rewrite replaces the file with the pending payments. Callers hold o.mu.
+func (o *Outbox) rewrite() error {
+	if o.file == nil {
+		return nil
+	}
+
+	tmpPath := o.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to rewrite outbox: %w", err)
+	}
+
+	writer := bufio.NewWriter(tmp)
+	for _, payment := range o.pending {
+		line, err := json.Marshal(newRecord(payment))
+		if err != nil {
+			continue
+		}
+		writer.Write(line)
+		writer.WriteByte('\n')
+	}
+
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to rewrite outbox: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync outbox: %w", err)
+	}
+	tmp.Close()
+
+	if err := os.Rename(tmpPath, o.path); err != nil {
+		return fmt.Errorf("failed to replace outbox: %w", err)
+	}
+	// Without it a crash can bring the old file back and replay what was stored
+	if err := syncDir(filepath.Dir(o.path)); err != nil {
+		return fmt.Errorf("failed to sync outbox directory: %w", err)
+	}
+
+	file, err := os.OpenFile(o.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to reopen outbox: %w", err)
+	}
+	o.file.Close()
+	o.file = file
+
+	return nil
+}
+
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
+
+// Purge drops every pending payment, used when the rest of the data is purged.
+func (o *Outbox) Purge() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.pending = nil
+	return o.rewrite()
+}
+
+func (o *Outbox) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.file == nil {
+		return nil
+	}
+	return o.file.Close()
+}
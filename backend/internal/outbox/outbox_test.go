@@ -0,0 +1,179 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"rinha-backend-arthur/internal/models"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func testPayment(amount models.Money) models.Payment {
+	return models.Payment{
+		PaymentRequest: models.PaymentRequest{
+			CorrelationId: uuid.New(),
+			Amount:        amount,
+			RequestedAt:   time.Date(2025, 7, 1, 12, 0, 0, 0, time.UTC),
+		},
+		Service: "default",
+	}
+}
+
+func openOutbox(t *testing.T, path string) *Outbox {
+	t.Helper()
+	o, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { o.Close() })
+	return o
+}
+
+func pendingIds(o *Outbox) []uuid.UUID {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	ids := make([]uuid.UUID, 0, len(o.pending))
+	for _, payment := range o.pending {
+		ids = append(ids, payment.CorrelationId)
+	}
+	return ids
+}
+
+func TestOutboxSurvivesARestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox", "payments.log")
+	first, second := testPayment(1990), testPayment(500)
+
+	o := openOutbox(t, path)
+	for _, payment := range []models.Payment{first, second, first} {
+		if err := o.Append(payment); err != nil {
+			t.Fatal(err)
+		}
+	}
+	o.Close() // A crash leaves the file as it is
+
+	reopened := openOutbox(t, path)
+	ids := pendingIds(reopened)
+	if len(ids) != 2 || ids[0] != first.CorrelationId || ids[1] != second.CorrelationId {
+		t.Fatalf("pending after reopen = %v, want %s and %s once each", ids, first.CorrelationId, second.CorrelationId)
+	}
+
+	var stored []models.Payment
+	flushed, err := reopened.Flush(context.Background(), func(ctx context.Context, payment models.Payment) error {
+		stored = append(stored, payment)
+		return nil
+	})
+	if err != nil || flushed != 2 {
+		t.Fatalf("Flush = %d, %v, want 2", flushed, err)
+	}
+	if stored[0] != first || stored[1] != second {
+		t.Fatalf("stored %+v, want the appended payments unchanged", stored)
+	}
+}
+
+func TestFlushRemovesOnlyWhatItStored(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "payments.log")
+	o := openOutbox(t, path)
+	first, second := testPayment(100), testPayment(200)
+	for _, payment := range []models.Payment{first, second} {
+		if err := o.Append(payment); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A worker appends while the flush is storing
+	late := testPayment(300)
+	flushed, err := o.Flush(context.Background(), func(ctx context.Context, payment models.Payment) error {
+		if payment.CorrelationId == first.CorrelationId {
+			return o.Append(late)
+		}
+		return nil
+	})
+	if err != nil || flushed != 2 {
+		t.Fatalf("Flush = %d, %v, want 2", flushed, err)
+	}
+
+	if ids := pendingIds(o); len(ids) != 1 || ids[0] != late.CorrelationId {
+		t.Fatalf("pending after Flush = %v, want only %s", ids, late.CorrelationId)
+	}
+	o.Close()
+	if ids := pendingIds(openOutbox(t, path)); len(ids) != 1 || ids[0] != late.CorrelationId {
+		t.Fatalf("pending after reopen = %v, want only %s", ids, late.CorrelationId)
+	}
+}
+
+func TestFlushKeepsPaymentsTheStoreRejected(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "payments.log")
+	o := openOutbox(t, path)
+	payments := []models.Payment{testPayment(100), testPayment(200), testPayment(300)}
+	for _, payment := range payments {
+		if err := o.Append(payment); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	storeDown := errors.New("store down")
+	flushed, err := o.Flush(context.Background(), func(ctx context.Context, payment models.Payment) error {
+		if payment.CorrelationId == payments[1].CorrelationId {
+			return storeDown
+		}
+		return nil
+	})
+	if !errors.Is(err, storeDown) || flushed != 1 {
+		t.Fatalf("Flush = %d, %v, want 1 and the store error", flushed, err)
+	}
+
+	want := []uuid.UUID{payments[1].CorrelationId, payments[2].CorrelationId}
+	o.Close()
+	ids := pendingIds(openOutbox(t, path))
+	if len(ids) != 2 || ids[0] != want[0] || ids[1] != want[1] {
+		t.Fatalf("pending after reopen = %v, want %v", ids, want)
+	}
+
+	// Nothing stored at all leaves the file alone
+	o = openOutbox(t, path)
+	if flushed, err := o.Flush(context.Background(), func(context.Context, models.Payment) error { return storeDown }); flushed != 0 || !errors.Is(err, storeDown) {
+		t.Fatalf("Flush with the store down = %d, %v", flushed, err)
+	}
+	if o.Backlog() != 2 {
+		t.Fatalf("Backlog = %d, want 2", o.Backlog())
+	}
+}
+
+func TestOpenSkipsATornLastLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "payments.log")
+	o := openOutbox(t, path)
+	kept := testPayment(100)
+	if err := o.Append(kept); err != nil {
+		t.Fatal(err)
+	}
+	o.Close()
+
+	// A crash mid-write leaves half a line
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"correlationId":"` + uuid.NewString() + `","amou`)
+	file.Close()
+
+	o = openOutbox(t, path)
+	if ids := pendingIds(o); len(ids) != 1 || ids[0] != kept.CorrelationId {
+		t.Fatalf("pending with a torn line = %v, want %s", ids, kept.CorrelationId)
+	}
+
+	// The next append starts a line of its own
+	next := testPayment(200)
+	if err := o.Append(next); err != nil {
+		t.Fatal(err)
+	}
+	o.Close()
+	ids := pendingIds(openOutbox(t, path))
+	if len(ids) != 2 || ids[0] != kept.CorrelationId || ids[1] != next.CorrelationId {
+		t.Fatalf("pending after appending past a torn line = %v, want %s and %s", ids, kept.CorrelationId, next.CorrelationId)
+	}
+}
@@ -0,0 +1,237 @@
+package queue
+
+import (
+	"context"
+	"rinha-backend-arthur/internal/models"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// MemoryQueue is an in-process queue backed by a bounded channel. It is not shared
+// between replicas and loses everything on restart, so it only fits a single instance
+// that explicitly trades durability for latency, local development and tests.
+type MemoryQueue struct {
+	messages chan models.QueueMessage
+
+	mu          sync.Mutex
+	nextID      uint64
+	inFlight    map[uint64]models.QueueMessage
+	retries     []memoryRetry // sorted by retryAt
+	deadLetters []models.QueueMessage
+}
+
+type memoryRetry struct {
+	msg     models.QueueMessage
+	retryAt time.Time
+}
+
+func NewMemoryQueue(capacity int) *MemoryQueue {
+	return &MemoryQueue{
+		messages: make(chan models.QueueMessage, capacity),
+		inFlight: make(map[uint64]models.QueueMessage),
+	}
+}
+
+func (q *MemoryQueue) Enqueue(ctx context.Context, msg models.QueueMessage) error {
+	select {
+	case q.messages <- msg:
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
+
+func (q *MemoryQueue) Dequeue(ctx context.Context, consumer int, max int, wait time.Duration) ([]Delivery, error) {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	var msgs []models.QueueMessage
+	select {
+	case msg := <-q.messages:
+		msgs = append(msgs, msg)
+	case <-timer.C:
+		return nil, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+drain:
+	for len(msgs) < max {
+		select {
+		case msg := <-q.messages:
+			msgs = append(msgs, msg)
+		default:
+			break drain
+		}
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	deliveries := make([]Delivery, 0, len(msgs))
+	for _, msg := range msgs {
+		q.nextID++
+		q.inFlight[q.nextID] = msg
+		deliveries = append(deliveries, Delivery{Message: msg, memoryID: q.nextID})
+	}
+
+	return deliveries, nil
+}
+
+func (q *MemoryQueue) Ack(ctx context.Context, delivery Delivery) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	delete(q.inFlight, delivery.memoryID)
+	return nil
+}
+
+func (q *MemoryQueue) Nack(ctx context.Context, delivery Delivery, retryAt time.Time) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	delete(q.inFlight, delivery.memoryID)
+
+	i := sort.Search(len(q.retries), func(i int) bool { return q.retries[i].retryAt.After(retryAt) })
+	q.retries = append(q.retries, memoryRetry{})
+	copy(q.retries[i+1:], q.retries[i:])
+	q.retries[i] = memoryRetry{msg: delivery.Message, retryAt: retryAt}
+
+	return nil
+}
+
+func (q *MemoryQueue) PromoteDueRetries(ctx context.Context, now time.Time, limit int) (int64, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var moved int64
+	for len(q.retries) > 0 && moved < int64(limit) && !q.retries[0].retryAt.After(now) {
+		if err := q.Enqueue(ctx, q.retries[0].msg); err != nil {
+			break // Queue is full, try again on the next tick
+		}
+		q.retries = q.retries[1:]
+		moved++
+	}
+
+	return moved, nil
+}
+
+// Reap has nothing to do: deliveries only die with the process that holds them, and so does
+// the queue. Requeueing slow but live deliveries would just send them twice.
+func (q *MemoryQueue) Reap(ctx context.Context, visibilityTimeout time.Duration) (int64, error) {
+	return 0, nil
+}
+
+func (q *MemoryQueue) Depth(ctx context.Context) (models.QueueMetrics, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return models.QueueMetrics{
+		Queued:       int64(len(q.messages)),
+		Processing:   int64(len(q.inFlight)),
+		Retrying:     int64(len(q.retries)),
+		DeadLettered: int64(len(q.deadLetters)),
+	}, nil
+}
+
+func (q *MemoryQueue) DeadLetter(ctx context.Context, delivery Delivery) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	delete(q.inFlight, delivery.memoryID)
+	// Newest first, like the Redis dead-letter list
+	q.deadLetters = append([]models.QueueMessage{delivery.Message}, q.deadLetters...)
+
+	return nil
+}
+
+func (q *MemoryQueue) ListDeadLetters(ctx context.Context, offset, limit int64) (models.DeadLetterListResponse, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	total := int64(len(q.deadLetters))
+	response := models.DeadLetterListResponse{
+		Total:   total,
+		Entries: []models.QueueMessage{},
+	}
+	if offset < total {
+		end := min(offset+limit, total)
+		response.Entries = append(response.Entries, q.deadLetters[offset:end]...)
+	}
+
+	return response, nil
+}
+
+func (q *MemoryQueue) GetDeadLetter(ctx context.Context, correlationId uuid.UUID) (*models.QueueMessage, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if i := q.findDeadLetter(correlationId); i >= 0 {
+		msg := q.deadLetters[i]
+		return &msg, nil
+	}
+	return nil, nil
+}
+
+func (q *MemoryQueue) ReplayDeadLetter(ctx context.Context, correlationId uuid.UUID) (bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	i := q.findDeadLetter(correlationId)
+	if i < 0 {
+		return false, nil
+	}
+
+	msg := q.deadLetters[i]
+	msg.Attempts = 0
+	if err := q.Enqueue(ctx, msg); err != nil {
+		return false, err
+	}
+	q.deadLetters = append(q.deadLetters[:i], q.deadLetters[i+1:]...)
+
+	return true, nil
+}
+
+func (q *MemoryQueue) DiscardDeadLetter(ctx context.Context, correlationId uuid.UUID) (bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	i := q.findDeadLetter(correlationId)
+	if i < 0 {
+		return false, nil
+	}
+	q.deadLetters = append(q.deadLetters[:i], q.deadLetters[i+1:]...)
+
+	return true, nil
+}
+
+func (q *MemoryQueue) findDeadLetter(correlationId uuid.UUID) int {
+	for i, msg := range q.deadLetters {
+		if msg.CorrelationId == correlationId {
+			return i
+		}
+	}
+	return -1
+}
+
+func (q *MemoryQueue) Purge(ctx context.Context) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+drain:
+	for {
+		select {
+		case <-q.messages:
+		default:
+			break drain
+		}
+	}
+	q.inFlight = make(map[uint64]models.QueueMessage)
+	q.retries = nil
+	q.deadLetters = nil
+
+	return nil
+}
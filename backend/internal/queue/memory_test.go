@@ -0,0 +1,35 @@
+package queue
+
+import (
+	"context"
+	"rinha-backend-arthur/internal/models"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestMemoryQueuePurgeDropsQueuedMessages(t *testing.T) {
+	ctx := context.Background()
+	q := NewMemoryQueue(10)
+	for range 3 {
+		if err := q.Enqueue(ctx, models.QueueMessage{CorrelationId: uuid.New()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := q.Dequeue(ctx, 0, 1, time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := q.Purge(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	depth, _ := q.Depth(ctx)
+	if depth != (models.QueueMetrics{}) {
+		t.Fatalf("Depth after Purge = %+v", depth)
+	}
+	if deliveries, _ := q.Dequeue(ctx, 0, 10, 10*time.Millisecond); len(deliveries) != 0 {
+		t.Fatalf("Dequeue after Purge = %v", deliveries)
+	}
+}
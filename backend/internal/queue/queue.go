@@ -0,0 +1,146 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"rinha-backend-arthur/internal/models"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ErrQueueFull is returned by Enqueue when a bounded queue has no room left.
+var ErrQueueFull = errors.New("queue is full")
+
+// Delivery is a message handed to a worker by Dequeue. It stays owned by that worker
+// until it is settled with Ack, Nack or DeadLetter.
+type Delivery struct {
+	Message models.QueueMessage
+	// DeliveryCount is how many times the queue handed this entry out, counting deliveries whose
+	// worker died before settling it. It is 0 when the backend doesn't track it.
+	DeliveryCount int64
+
+	raw             string
+	processingQueue string
+	claimsKey       string
+	streamID        string
+	streamKey       string
+	memoryID        uint64
+}
+
+type AckMode string
+
+const (
+	AckNone   AckMode = ""       // the queue isn't in Redis, call Queue.Ack
+	AckList   AckMode = "list"   // KEYS: processing list, claims set. ARGV: raw entry, claim member
+	AckStream AckMode = "stream" // KEYS: stream. ARGV: group, entry ID
+)
+
+// AckSpec describes the Redis commands that remove a delivery from the queue, so the
+// store can run them in the same script that records the payment.
+type AckSpec struct {
+	Mode AckMode
+	Keys []string
+	Args []string
+}
+
+type PushMode string
+
+const (
+	PushNone   PushMode = ""       // the queue isn't in Redis, call Queue.Enqueue
+	PushList   PushMode = "list"   // KEYS: queue list. ARGV: message
+	PushStream PushMode = "stream" // KEYS: stream. ARGV: message field, message
+)
+
+// PushSpec describes the Redis command that enqueues a message, so the store can run it
+// in the same script that accepts the payment.
+type PushSpec struct {
+	Mode PushMode
+	Keys []string
+	Args []string
+}
+
+type DiscardMode string
+
+const (
+	DiscardNone DiscardMode = ""     // the queue isn't in Redis, call DeadLetterQueue.DiscardDeadLetter
+	DiscardList DiscardMode = "list" // KEYS: dead-letter list. ARGV: raw entry
+)
+
+// DiscardSpec describes the Redis command that removes a dead letter, so the store can
+// forget the payment in the same step.
+type DiscardSpec struct {
+	Mode DiscardMode
+	Keys []string
+	Args []string
+}
+
+type Queue interface {
+	Enqueue(ctx context.Context, msg models.QueueMessage) error
+	// Dequeue waits up to wait for a message and returns it together with up to
+	// max-1 more messages if they are already waiting. It returns no deliveries and
+	// no error when the wait expires.
+	Dequeue(ctx context.Context, consumer int, max int, wait time.Duration) ([]Delivery, error)
+	Ack(ctx context.Context, delivery Delivery) error
+	// Nack gives the delivery back, carrying delivery.Message as updated by the worker.
+	// It becomes visible again once RetryQueue.PromoteDueRetries runs after retryAt.
+	Nack(ctx context.Context, delivery Delivery, retryAt time.Time) error
+	Depth(ctx context.Context) (models.QueueMetrics, error)
+}
+
+// DeadLetterQueue keeps the deliveries that ran out of attempts until they are replayed or discarded.
+type DeadLetterQueue interface {
+	// DeadLetter moves a delivery that ran out of attempts to the dead-letter queue.
+	DeadLetter(ctx context.Context, delivery Delivery) error
+	ListDeadLetters(ctx context.Context, offset, limit int64) (models.DeadLetterListResponse, error)
+	// GetDeadLetter returns nil when there is no dead letter for the correlationId.
+	GetDeadLetter(ctx context.Context, correlationId uuid.UUID) (*models.QueueMessage, error)
+	// ReplayDeadLetter moves a dead letter back to the queue with a fresh attempt count.
+	ReplayDeadLetter(ctx context.Context, correlationId uuid.UUID) (bool, error)
+	DiscardDeadLetter(ctx context.Context, correlationId uuid.UUID) (bool, error)
+}
+
+// RetryQueue brings nacked and orphaned deliveries back.
+type RetryQueue interface {
+	// PromoteDueRetries makes nacked messages whose retryAt passed visible again.
+	PromoteDueRetries(ctx context.Context, now time.Time, limit int) (int64, error)
+	// Reap gives back deliveries held longer than visibilityTimeout by workers that died.
+	Reap(ctx context.Context, visibilityTimeout time.Duration) (int64, error)
+}
+
+type Purger interface {
+	// Purge drops queued messages, retries, dead letters and in-flight bookkeeping.
+	Purge(ctx context.Context) error
+}
+
+// ScriptedQueue is a queue in Redis whose commands the Redis store runs in its own scripts,
+// so accepting, settling and discarding a payment update the queue in the same step.
+type ScriptedQueue interface {
+	// PushSpec describes how to enqueue msg from a store script.
+	PushSpec(msg models.QueueMessage) (PushSpec, error)
+	// AckSpec describes how to ack delivery from a store script.
+	AckSpec(delivery Delivery) AckSpec
+	// DiscardSpec describes how to remove the dead letter of correlationId from a store script.
+	// It reports false when there is no such dead letter.
+	DiscardSpec(ctx context.Context, correlationId uuid.UUID) (DiscardSpec, bool, error)
+}
+
+// decodeMessage reads a queue entry. Entries enqueued before the envelope
+// existed are the raw payment body and are wrapped on the fly.
+func decodeMessage(raw string) (models.QueueMessage, error) {
+	var msg models.QueueMessage
+	if err := json.Unmarshal([]byte(raw), &msg); err != nil {
+		return models.QueueMessage{}, fmt.Errorf("failed to unmarshal queue message: %w", err)
+	}
+
+	if len(msg.Payload) == 0 {
+		msg = models.QueueMessage{
+			CorrelationId: msg.CorrelationId,
+			Payload:       json.RawMessage(raw),
+		}
+	}
+
+	return msg, nil
+}
@@ -0,0 +1,284 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"rinha-backend-arthur/internal/keyspace"
+	"rinha-backend-arthur/internal/models"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+// redisQueue holds what the list and stream backends share: the retry set, the
+// dead-letter list and the reaper lock. push and release are the backend specific parts.
+// All its keys live under queue:* in the deployment keyspace.
+type redisQueue struct {
+	client        redis.UniversalClient
+	keys          keyspace.Keyspace
+	queueKey      string
+	retryKey      string
+	deadLetterKey string
+	reaperLockKey string
+	promoteScript *redis.Script
+	push          func(ctx context.Context, cmd redis.Cmdable, msgJSON []byte) error
+	pushSpec      func(msgJSON []byte) PushSpec
+	release       func(ctx context.Context, pipe redis.Pipeliner, delivery Delivery)
+}
+
+func (q *redisQueue) Enqueue(ctx context.Context, msg models.QueueMessage) error {
+	msgJSON, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("failed to marshal queue message: %w", err)
+	}
+
+	if err := q.push(ctx, q.client, msgJSON); err != nil {
+		return fmt.Errorf("failed to enqueue payment: %w", err)
+	}
+
+	return nil
+}
+
+func (q *redisQueue) PushSpec(msg models.QueueMessage) (PushSpec, error) {
+	msgJSON, err := json.Marshal(msg)
+	if err != nil {
+		return PushSpec{}, fmt.Errorf("failed to marshal queue message: %w", err)
+	}
+	return q.pushSpec(msgJSON), nil
+}
+
+func (q *redisQueue) Ack(ctx context.Context, delivery Delivery) error {
+	pipe := q.client.TxPipeline()
+	q.release(ctx, pipe, delivery)
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to ack payment: %w", err)
+	}
+
+	return nil
+}
+
+func (q *redisQueue) AckSpec(delivery Delivery) AckSpec {
+	switch {
+	case delivery.streamID != "":
+		return AckSpec{
+			Mode: AckStream,
+			Keys: []string{delivery.streamKey},
+			Args: []string{paymentsStreamGroup, delivery.streamID},
+		}
+	case delivery.processingQueue != "":
+		return AckSpec{
+			Mode: AckList,
+			Keys: []string{delivery.processingQueue, delivery.claimsKey},
+			Args: []string{delivery.raw, claimMember(delivery.processingQueue, delivery.raw)},
+		}
+	}
+	return AckSpec{Mode: AckNone}
+}
+
+// Nack moves the delivery to the retry set, scored by the time it is due.
+func (q *redisQueue) Nack(ctx context.Context, delivery Delivery, retryAt time.Time) error {
+	msgJSON, err := json.Marshal(delivery.Message)
+	if err != nil {
+		return fmt.Errorf("failed to marshal queue message: %w", err)
+	}
+
+	pipe := q.client.TxPipeline()
+	q.release(ctx, pipe, delivery)
+	pipe.ZAdd(ctx, q.retryKey, redis.Z{
+		Score:  float64(retryAt.UnixMilli()),
+		Member: msgJSON,
+	})
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to schedule payment retry: %w", err)
+	}
+
+	return nil
+}
+
+func (q *redisQueue) PromoteDueRetries(ctx context.Context, now time.Time, limit int) (int64, error) {
+	moved, err := q.promoteScript.Run(ctx, q.client,
+		[]string{q.retryKey, q.queueKey},
+		strconv.FormatInt(now.UnixMilli(), 10), limit,
+	).Int64()
+	if err != nil {
+		return 0, fmt.Errorf("failed to promote due retries: %w", err)
+	}
+	return moved, nil
+}
+
+func (q *redisQueue) DeadLetter(ctx context.Context, delivery Delivery) error {
+	msgJSON, err := json.Marshal(delivery.Message)
+	if err != nil {
+		return fmt.Errorf("failed to marshal queue message: %w", err)
+	}
+
+	pipe := q.client.TxPipeline()
+	q.release(ctx, pipe, delivery)
+	pipe.LPush(ctx, q.deadLetterKey, msgJSON)
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to move payment to the dead-letter queue: %w", err)
+	}
+
+	return nil
+}
+
+func (q *redisQueue) ListDeadLetters(ctx context.Context, offset, limit int64) (models.DeadLetterListResponse, error) {
+	pipe := q.client.Pipeline()
+	total := pipe.LLen(ctx, q.deadLetterKey)
+	entries := pipe.LRange(ctx, q.deadLetterKey, offset, offset+limit-1)
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return models.DeadLetterListResponse{}, fmt.Errorf("failed to list dead letters: %w", err)
+	}
+
+	response := models.DeadLetterListResponse{
+		Total:   total.Val(),
+		Entries: make([]models.QueueMessage, 0, len(entries.Val())),
+	}
+	for _, raw := range entries.Val() {
+		msg, err := decodeMessage(raw)
+		if err != nil {
+			continue // Skip malformed data
+		}
+		response.Entries = append(response.Entries, msg)
+	}
+
+	return response, nil
+}
+
+func (q *redisQueue) GetDeadLetter(ctx context.Context, correlationId uuid.UUID) (*models.QueueMessage, error) {
+	msg, _, err := q.findDeadLetter(ctx, correlationId)
+	return msg, err
+}
+
+func (q *redisQueue) ReplayDeadLetter(ctx context.Context, correlationId uuid.UUID) (bool, error) {
+	msg, raw, err := q.findDeadLetter(ctx, correlationId)
+	if err != nil || msg == nil {
+		return false, err
+	}
+
+	msg.Attempts = 0
+	msgJSON, err := json.Marshal(msg)
+	if err != nil {
+		return false, fmt.Errorf("failed to marshal queue message: %w", err)
+	}
+
+	pipe := q.client.TxPipeline()
+	removed := pipe.LRem(ctx, q.deadLetterKey, 1, raw)
+	q.push(ctx, pipe, msgJSON)
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return false, fmt.Errorf("failed to replay dead letter: %w", err)
+	}
+
+	return removed.Val() > 0, nil
+}
+
+func (q *redisQueue) DiscardDeadLetter(ctx context.Context, correlationId uuid.UUID) (bool, error) {
+	msg, raw, err := q.findDeadLetter(ctx, correlationId)
+	if err != nil || msg == nil {
+		return false, err
+	}
+
+	removed, err := q.client.LRem(ctx, q.deadLetterKey, 1, raw).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to discard dead letter: %w", err)
+	}
+
+	return removed > 0, nil
+}
+
+func (q *redisQueue) DiscardSpec(ctx context.Context, correlationId uuid.UUID) (DiscardSpec, bool, error) {
+	msg, raw, err := q.findDeadLetter(ctx, correlationId)
+	if err != nil || msg == nil {
+		return DiscardSpec{}, false, err
+	}
+	return DiscardSpec{Mode: DiscardList, Keys: []string{q.deadLetterKey}, Args: []string{raw}}, true, nil
+}
+
+func (q *redisQueue) findDeadLetter(ctx context.Context, correlationId uuid.UUID) (*models.QueueMessage, string, error) {
+	entries, err := q.client.LRange(ctx, q.deadLetterKey, 0, -1).Result()
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to retrieve dead letters: %w", err)
+	}
+
+	for _, raw := range entries {
+		msg, err := decodeMessage(raw)
+		if err != nil {
+			continue
+		}
+		if msg.CorrelationId == correlationId {
+			return &msg, raw, nil
+		}
+	}
+
+	return nil, "", nil
+}
+
+// withReaperLock makes sure only one replica reaps at a time, replicas share the queue.
+func (q *redisQueue) withReaperLock(ctx context.Context, ttl time.Duration, reap func() (int64, error)) (int64, error) {
+	token, err := keyspace.AcquireLock(ctx, q.client, q.reaperLockKey, ttl)
+	if err != nil || token == "" {
+		return 0, err
+	}
+	defer keyspace.ReleaseLock(ctx, q.client, q.reaperLockKey, token)
+
+	return reap()
+}
+
+func newRedisQueue(client redis.UniversalClient, keys keyspace.Keyspace, queueKey string) redisQueue {
+	return redisQueue{
+		client:        client,
+		keys:          keys,
+		queueKey:      queueKey,
+		retryKey:      keys.Key("queue", "retry"),
+		deadLetterKey: keys.Key("queue", "dlq"),
+		reaperLockKey: keys.Key("queue", "reaper_lock"),
+	}
+}
+
+// purge deletes every queue key of the deployment: the main queue, processing lists,
+// claims, retries and dead letters.
+func (q *redisQueue) purge(ctx context.Context) error {
+	if _, err := keyspace.Delete(ctx, q.client, q.keys.Match("queue")); err != nil {
+		return fmt.Errorf("failed to purge queue: %w", err)
+	}
+	return nil
+}
+
+// AdoptLegacyKeys moves the queue keys of either backend written before keys had a prefix into
+// keys and returns how many it moved. The legacy claims are dropped, they name the old processing
+// lists: the reaper claims the moved lists again and requeues what isn't acked in time.
+// A key whose new name is taken already is left in place and reported in the error.
+func AdoptLegacyKeys(ctx context.Context, client redis.UniversalClient, keys keyspace.Keyspace) (int, error) {
+	adopted, conflicts := keyspace.AdoptAll(ctx, client, map[string]string{
+		"payments:queue":  keys.Key("queue"),
+		"payments:stream": keys.Key("queue", "stream"),
+		"payments:retry":  keys.Key("queue", "retry"),
+		"payments:dlq":    keys.Key("queue", "dlq"),
+	})
+	if conflicts != nil && !errors.Is(conflicts, keyspace.ErrKeyExists) {
+		return adopted, conflicts
+	}
+
+	processing, err := keyspace.AdoptMatching(ctx, client, "payments:processing:*", func(legacy string) string {
+		return keys.Key("queue", "processing", strings.TrimPrefix(legacy, "payments:processing:"))
+	})
+	adopted += processing
+	if err != nil && !errors.Is(err, keyspace.ErrKeyExists) {
+		return adopted, err
+	}
+
+	if err := client.Del(ctx, "payments:claims").Err(); err != nil {
+		return adopted, fmt.Errorf("failed to drop legacy claims: %w", err)
+	}
+	return adopted, errors.Join(conflicts, err)
+}
@@ -0,0 +1,202 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"rinha-backend-arthur/internal/keyspace"
+	"rinha-backend-arthur/internal/models"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// promoteDueRetriesScript moves up to ARGV[2] entries whose score is <= ARGV[1]
+// from the retry set to the main queue. Running it in Redis keeps replicas from
+// promoting the same entry twice.
+var promoteDueRetriesScript = redis.NewScript(`
+local due = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, tonumber(ARGV[2]))
+for _, member in ipairs(due) do
+	redis.call('ZREM', KEYS[1], member)
+	redis.call('LPUSH', KEYS[2], member)
+end
+return #due
+`)
+
+// reapProcessingQueueScript requeues the entries of one processing list whose claim is
+// older than the visibility timeout. Entries without a claim (the worker died between
+// the move and the claim) are claimed now so they expire on a later pass.
+var reapProcessingQueueScript = redis.NewScript(`
+local items = redis.call('LRANGE', KEYS[1], 0, -1)
+local now = tonumber(ARGV[1])
+local timeout = tonumber(ARGV[2])
+local reaped = 0
+for _, raw in ipairs(items) do
+	local member = KEYS[1] .. '|' .. raw
+	local claimedAt = redis.call('ZSCORE', KEYS[2], member)
+	if not claimedAt then
+		redis.call('ZADD', KEYS[2], now, member)
+	elseif tonumber(claimedAt) + timeout <= now then
+		redis.call('LREM', KEYS[1], 1, raw)
+		redis.call('ZREM', KEYS[2], member)
+		redis.call('LPUSH', KEYS[3], raw)
+		reaped = reaped + 1
+	end
+end
+return reaped
+`)
+
+// RedisListQueue keeps the queue in a Redis list. Workers move entries into their own
+// queue:processing:N list and a claims sorted set records when they did.
+type RedisListQueue struct {
+	redisQueue
+	claimsKey string
+}
+
+func NewRedisListQueue(client redis.UniversalClient, keys keyspace.Keyspace) *RedisListQueue {
+	q := &RedisListQueue{claimsKey: keys.Key("queue", "claims")}
+	q.redisQueue = newRedisQueue(client, keys, keys.Key("queue"))
+	q.promoteScript = promoteDueRetriesScript
+	q.push = func(ctx context.Context, cmd redis.Cmdable, msgJSON []byte) error {
+		return cmd.LPush(ctx, q.queueKey, msgJSON).Err()
+	}
+	q.pushSpec = func(msgJSON []byte) PushSpec {
+		return PushSpec{Mode: PushList, Keys: []string{q.queueKey}, Args: []string{string(msgJSON)}}
+	}
+	q.release = func(ctx context.Context, pipe redis.Pipeliner, delivery Delivery) {
+		pipe.LRem(ctx, delivery.processingQueue, 1, delivery.raw)
+		pipe.ZRem(ctx, q.claimsKey, claimMember(delivery.processingQueue, delivery.raw))
+	}
+	return q
+}
+
+func (q *RedisListQueue) processingQueueKey(consumer int) string {
+	return q.keys.Key("queue", "processing", strconv.Itoa(consumer))
+}
+
+func (q *RedisListQueue) processingQueueMatch() string {
+	return q.keys.Match("queue", "processing", "")
+}
+
+func claimMember(processingQueue, raw string) string {
+	return processingQueue + "|" + raw
+}
+
+func (q *RedisListQueue) Dequeue(ctx context.Context, consumer int, max int, wait time.Duration) ([]Delivery, error) {
+	processingQueue := q.processingQueueKey(consumer)
+	first, err := q.client.BLMove(ctx, q.queueKey, processingQueue, "RIGHT", "LEFT", wait).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim payment: %w", err)
+	}
+
+	claimed := []string{first}
+
+	if max > 1 {
+		pipe := q.client.Pipeline()
+		moves := make([]*redis.StringCmd, 0, max-1)
+		for range max - 1 {
+			moves = append(moves, pipe.LMove(ctx, q.queueKey, processingQueue, "RIGHT", "LEFT"))
+		}
+		pipe.Exec(ctx) // redis.Nil on the moves past the end of the queue is expected
+
+		for _, move := range moves {
+			if raw, err := move.Result(); err == nil {
+				claimed = append(claimed, raw)
+			}
+		}
+	}
+
+	// If this fails the reaper claims the unmarked entries on its next pass
+	q.markClaimed(ctx, processingQueue, claimed)
+
+	deliveries := make([]Delivery, 0, len(claimed))
+	for _, raw := range claimed {
+		delivery := Delivery{raw: raw, processingQueue: processingQueue, claimsKey: q.claimsKey}
+		msg, err := decodeMessage(raw)
+		if err != nil {
+			q.Ack(ctx, delivery) // Drop malformed data
+			continue
+		}
+		delivery.Message = msg
+		deliveries = append(deliveries, delivery)
+	}
+
+	return deliveries, nil
+}
+
+func (q *RedisListQueue) markClaimed(ctx context.Context, processingQueue string, raws []string) error {
+	now := float64(time.Now().UnixMilli())
+	members := make([]redis.Z, 0, len(raws))
+	for _, raw := range raws {
+		members = append(members, redis.Z{Score: now, Member: claimMember(processingQueue, raw)})
+	}
+	return q.client.ZAdd(ctx, q.claimsKey, members...).Err()
+}
+
+func (q *RedisListQueue) Reap(ctx context.Context, visibilityTimeout time.Duration) (int64, error) {
+	return q.withReaperLock(ctx, visibilityTimeout, func() (int64, error) {
+		now := time.Now()
+		var reaped int64
+
+		err := keyspace.Scan(ctx, q.client, q.processingQueueMatch(), func(processingQueue string) error {
+			count, err := reapProcessingQueueScript.Run(ctx, q.client,
+				[]string{processingQueue, q.claimsKey, q.queueKey},
+				now.UnixMilli(), visibilityTimeout.Milliseconds(),
+			).Int64()
+			if err != nil {
+				return fmt.Errorf("failed to reap %s: %w", processingQueue, err)
+			}
+			reaped += count
+			return nil
+		})
+		if err != nil {
+			return reaped, fmt.Errorf("failed to scan processing queues: %w", err)
+		}
+
+		// Whatever is still expired has no entry left in any processing list
+		maxScore := strconv.FormatInt(now.Add(-visibilityTimeout).UnixMilli(), 10)
+		if err := q.client.ZRemRangeByScore(ctx, q.claimsKey, "-inf", maxScore).Err(); err != nil {
+			return reaped, fmt.Errorf("failed to drop stale claims: %w", err)
+		}
+
+		return reaped, nil
+	})
+}
+
+func (q *RedisListQueue) Depth(ctx context.Context) (models.QueueMetrics, error) {
+	pipe := q.client.Pipeline()
+	queued := pipe.LLen(ctx, q.queueKey)
+	retrying := pipe.ZCard(ctx, q.retryKey)
+	deadLettered := pipe.LLen(ctx, q.deadLetterKey)
+
+	var processing []*redis.IntCmd
+	err := keyspace.Scan(ctx, q.client, q.processingQueueMatch(), func(processingQueue string) error {
+		processing = append(processing, pipe.LLen(ctx, processingQueue))
+		return nil
+	})
+	if err != nil {
+		return models.QueueMetrics{}, fmt.Errorf("failed to scan processing queues: %w", err)
+	}
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return models.QueueMetrics{}, fmt.Errorf("failed to retrieve queue metrics: %w", err)
+	}
+
+	metrics := models.QueueMetrics{
+		Queued:       queued.Val(),
+		Retrying:     retrying.Val(),
+		DeadLettered: deadLettered.Val(),
+	}
+	for _, cmd := range processing {
+		metrics.Processing += cmd.Val()
+	}
+
+	return metrics, nil
+}
+
+func (q *RedisListQueue) Purge(ctx context.Context) error {
+	return q.purge(ctx)
+}
@@ -0,0 +1,166 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"rinha-backend-arthur/internal/models"
+	"rinha-backend-arthur/internal/redistest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+// Run against a real server for meaningful numbers:
+//
+//	TEST_REDIS_URL=redis://localhost:6379 go test ./internal/queue -run '^$' -bench Dequeue
+
+// BenchmarkDequeueLatency measures the time from Enqueue until a waiting worker holds the payment,
+// with the blocking move and with the polling loop it replaced (RPOPLPUSH, 100ms sleep when empty).
+func BenchmarkDequeueLatency(b *testing.B) {
+	b.Run("blocking", func(b *testing.B) {
+		benchmarkDequeueLatency(b, func(ctx context.Context, q *RedisListQueue) error {
+			for {
+				deliveries, err := q.Dequeue(ctx, 0, 1, time.Second)
+				if err != nil || len(deliveries) > 0 {
+					return err
+				}
+			}
+		})
+	})
+
+	b.Run("polling", func(b *testing.B) {
+		benchmarkDequeueLatency(b, func(ctx context.Context, q *RedisListQueue) error {
+			for {
+				err := q.client.RPopLPush(ctx, q.queueKey, q.processingQueueKey(0)).Err()
+				if err != redis.Nil {
+					return err
+				}
+				select {
+				case <-time.After(100 * time.Millisecond):
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+		})
+	})
+}
+
+func benchmarkDequeueLatency(b *testing.B, take func(ctx context.Context, q *RedisListQueue) error) {
+	client, keys := redistest.Client(b)
+	q := NewRedisListQueue(client, keys)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	taken := make(chan error)
+	go func() {
+		for ctx.Err() == nil {
+			taken <- take(ctx, q)
+		}
+	}()
+
+	msg := benchmarkMessage()
+	b.ResetTimer()
+	for range b.N {
+		if err := q.Enqueue(ctx, msg); err != nil {
+			b.Fatal(err)
+		}
+		if err := <-taken; err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	cancel()
+	go func() {
+		for range taken {
+		}
+	}()
+}
+
+// BenchmarkDequeueBatch measures the cost per payment of draining a full queue one entry or
+// a batch per round-trip.
+func BenchmarkDequeueBatch(b *testing.B) {
+	for _, batch := range []int{1, 10} {
+		b.Run(fmt.Sprintf("batch=%d", batch), func(b *testing.B) {
+			client, keys := redistest.Client(b)
+			q := NewRedisListQueue(client, keys)
+			ctx := context.Background()
+
+			msg := benchmarkMessage()
+			for range b.N {
+				if err := q.Enqueue(ctx, msg); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			b.ResetTimer()
+			for taken := 0; taken < b.N; {
+				deliveries, err := q.Dequeue(ctx, 0, batch, time.Second)
+				if err != nil {
+					b.Fatal(err)
+				}
+				taken += len(deliveries)
+			}
+		})
+	}
+}
+
+func benchmarkMessage() models.QueueMessage {
+	return models.QueueMessage{
+		CorrelationId: uuid.New(),
+		Payload:       []byte(`{"correlationId":"4a7901b8-7d26-4d9d-aa19-4dc1c7cf60b3","amount":19.90}`),
+	}
+}
+
+func TestAdoptLegacyListKeys(t *testing.T) {
+	if os.Getenv("TEST_REDIS_URL") != "" {
+		t.Skip("legacy keys have no prefix, they would clash on a shared server")
+	}
+	client, keys := redistest.Client(t)
+	ctx := context.Background()
+
+	queued, processing := benchmarkMessage(), benchmarkMessage()
+	queuedJSON, _ := json.Marshal(queued)
+	processingJSON, _ := json.Marshal(processing)
+	client.LPush(ctx, "payments:queue", queuedJSON)
+	client.LPush(ctx, "payments:processing:3", processingJSON)
+	client.ZAdd(ctx, "payments:claims", redis.Z{Score: 1, Member: "payments:processing:3|" + string(processingJSON)})
+	client.ZAdd(ctx, "payments:retry", redis.Z{Score: 1, Member: "retry"})
+	client.LPush(ctx, "payments:dlq", "dead")
+
+	adopted, err := AdoptLegacyKeys(ctx, client, keys)
+	if err != nil || adopted != 4 {
+		t.Fatalf("AdoptLegacyKeys = %d, %v, want 4 keys moved", adopted, err)
+	}
+	if n := client.Exists(ctx, "payments:claims").Val(); n != 0 {
+		t.Fatal("the legacy claims were not dropped")
+	}
+
+	q := NewRedisListQueue(client, keys)
+	if n := client.ZCard(ctx, q.retryKey).Val(); n != 1 {
+		t.Fatalf("retry set has %d entries, want 1", n)
+	}
+	deliveries, err := q.Dequeue(ctx, 0, 10, 0)
+	if err != nil || len(deliveries) != 1 || deliveries[0].Message.CorrelationId != queued.CorrelationId {
+		t.Fatalf("Dequeue = %v, %v, want the legacy queued payment", deliveries, err)
+	}
+	if err := q.Ack(ctx, deliveries[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	// The moved processing list has no claims, the reaper claims it and then requeues it
+	if _, err := q.Reap(ctx, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if reaped, err := q.Reap(ctx, time.Millisecond); err != nil || reaped != 1 {
+		t.Fatalf("Reap = %d, %v, want the legacy processing entry", reaped, err)
+	}
+	deliveries, err = q.Dequeue(ctx, 0, 10, 0)
+	if err != nil || len(deliveries) != 1 || deliveries[0].Message.CorrelationId != processing.CorrelationId {
+		t.Fatalf("Dequeue after Reap = %v, %v, want the legacy processing payment", deliveries, err)
+	}
+}
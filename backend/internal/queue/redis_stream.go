@@ -0,0 +1,242 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"rinha-backend-arthur/internal/keyspace"
+	"rinha-backend-arthur/internal/models"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	paymentsStreamGroup = "payments"
+	streamMessageField  = "message"
+	streamReaperName    = "reaper"
+	streamReclaimBatch  = 100 // entries Reap hands to the workers at most at once
+)
+
+// promoteDueRetriesToStreamScript is promoteDueRetriesScript for the streams backend.
+var promoteDueRetriesToStreamScript = redis.NewScript(`
+local due = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, tonumber(ARGV[2]))
+for _, member in ipairs(due) do
+	redis.call('ZREM', KEYS[1], member)
+	redis.call('XADD', KEYS[2], '*', 'message', member)
+end
+return #due
+`)
+
+// RedisStreamQueue keeps the queue in a Redis stream read through a consumer group,
+// which tracks pending entries, delivery counts and the consumer holding each entry.
+// Acked entries are deleted so the stream only holds queued and pending payments.
+type RedisStreamQueue struct {
+	redisQueue
+	consumerName string
+	reclaimed    chan Delivery // entries Reap claimed for this replica's workers
+}
+
+// NewRedisStreamQueue creates the consumer group if needed. consumerName identifies this replica in the group.
+func NewRedisStreamQueue(ctx context.Context, client redis.UniversalClient, keys keyspace.Keyspace, consumerName string) (*RedisStreamQueue, error) {
+	q := &RedisStreamQueue{
+		consumerName: consumerName,
+		reclaimed:    make(chan Delivery, streamReclaimBatch),
+	}
+	q.redisQueue = newRedisQueue(client, keys, keys.Key("queue", "stream"))
+	q.promoteScript = promoteDueRetriesToStreamScript
+	q.push = func(ctx context.Context, cmd redis.Cmdable, msgJSON []byte) error {
+		return cmd.XAdd(ctx, &redis.XAddArgs{
+			Stream: q.queueKey,
+			Values: []string{streamMessageField, string(msgJSON)},
+		}).Err()
+	}
+	q.pushSpec = func(msgJSON []byte) PushSpec {
+		return PushSpec{Mode: PushStream, Keys: []string{q.queueKey}, Args: []string{streamMessageField, string(msgJSON)}}
+	}
+	q.release = func(ctx context.Context, pipe redis.Pipeliner, delivery Delivery) {
+		pipe.XAck(ctx, q.queueKey, paymentsStreamGroup, delivery.streamID)
+		pipe.XDel(ctx, q.queueKey, delivery.streamID)
+	}
+
+	return q, q.createGroup(ctx)
+}
+
+func (q *RedisStreamQueue) createGroup(ctx context.Context) error {
+	err := q.client.XGroupCreateMkStream(ctx, q.queueKey, paymentsStreamGroup, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return fmt.Errorf("failed to create stream consumer group: %w", err)
+	}
+	return nil
+}
+
+func (q *RedisStreamQueue) Dequeue(ctx context.Context, consumer int, max int, wait time.Duration) ([]Delivery, error) {
+	var deliveries []Delivery
+	for len(deliveries) < max {
+		select {
+		case delivery := <-q.reclaimed:
+			deliveries = append(deliveries, delivery)
+			continue
+		default:
+		}
+		break
+	}
+	if len(deliveries) > 0 {
+		return deliveries, nil
+	}
+
+	streams, err := q.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    paymentsStreamGroup,
+		Consumer: fmt.Sprintf("%s-%d", q.consumerName, consumer),
+		Streams:  []string{q.queueKey, ">"},
+		Count:    int64(max),
+		Block:    wait,
+	}).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read payments stream: %w", err)
+	}
+
+	for _, stream := range streams {
+		for _, message := range stream.Messages {
+			delivery, ok := q.decodeDelivery(ctx, message)
+			if !ok {
+				continue
+			}
+			delivery.DeliveryCount = 1 // New entries are read once
+			deliveries = append(deliveries, delivery)
+		}
+	}
+
+	return deliveries, nil
+}
+
+// deliveries decodes claimed entries and reads how many times each was delivered from XPENDING.
+func (q *RedisStreamQueue) deliveries(ctx context.Context, messages []redis.XMessage) ([]Delivery, error) {
+	if len(messages) == 0 {
+		return nil, nil
+	}
+
+	pipe := q.client.Pipeline()
+	pending := make([]*redis.XPendingExtCmd, len(messages))
+	for i, message := range messages {
+		pending[i] = pipe.XPendingExt(ctx, &redis.XPendingExtArgs{
+			Stream: q.queueKey,
+			Group:  paymentsStreamGroup,
+			Start:  message.ID,
+			End:    message.ID,
+			Count:  1,
+		})
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, fmt.Errorf("failed to read stream delivery counts: %w", err)
+	}
+
+	deliveries := make([]Delivery, 0, len(messages))
+	for i, message := range messages {
+		delivery, ok := q.decodeDelivery(ctx, message)
+		if !ok {
+			continue
+		}
+		if entries := pending[i].Val(); len(entries) == 1 {
+			delivery.DeliveryCount = entries[0].RetryCount
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, nil
+}
+
+func (q *RedisStreamQueue) decodeDelivery(ctx context.Context, message redis.XMessage) (Delivery, bool) {
+	delivery := q.streamDelivery(message)
+	msg, err := decodeMessage(delivery.raw)
+	if err != nil {
+		q.Ack(ctx, delivery) // Drop malformed data
+		return Delivery{}, false
+	}
+	delivery.Message = msg
+	return delivery, true
+}
+
+func (q *RedisStreamQueue) streamDelivery(message redis.XMessage) Delivery {
+	raw, _ := message.Values[streamMessageField].(string)
+	return Delivery{raw: raw, streamID: message.ID, streamKey: q.queueKey}
+}
+
+// Reap claims the entries pending longer than visibilityTimeout for this replica and hands them
+// to its workers through Dequeue. They stay pending in the group, so their delivery count goes on
+// and a replica dying with them only makes them idle again.
+func (q *RedisStreamQueue) Reap(ctx context.Context, visibilityTimeout time.Duration) (int64, error) {
+	return q.withReaperLock(ctx, visibilityTimeout, func() (int64, error) {
+		var reaped int64
+		start := "0-0"
+
+		for room := cap(q.reclaimed) - len(q.reclaimed); room > 0; room = cap(q.reclaimed) - len(q.reclaimed) {
+			messages, next, err := q.client.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+				Stream:   q.queueKey,
+				Group:    paymentsStreamGroup,
+				Consumer: q.consumerName + "-" + streamReaperName,
+				MinIdle:  visibilityTimeout,
+				Start:    start,
+				Count:    int64(room),
+			}).Result()
+			if err != nil {
+				return reaped, fmt.Errorf("failed to autoclaim stream entries: %w", err)
+			}
+
+			deliveries, err := q.deliveries(ctx, messages)
+			if err != nil {
+				return reaped, err
+			}
+			for _, delivery := range deliveries {
+				q.reclaimed <- delivery
+				reaped++
+			}
+
+			if next == "0-0" || len(messages) == 0 {
+				break
+			}
+			start = next
+		}
+
+		return reaped, nil
+	})
+}
+
+func (q *RedisStreamQueue) Depth(ctx context.Context) (models.QueueMetrics, error) {
+	pipe := q.client.Pipeline()
+	length := pipe.XLen(ctx, q.queueKey)
+	pending := pipe.XPending(ctx, q.queueKey, paymentsStreamGroup)
+	retrying := pipe.ZCard(ctx, q.retryKey)
+	deadLettered := pipe.LLen(ctx, q.deadLetterKey)
+
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return models.QueueMetrics{}, fmt.Errorf("failed to retrieve queue metrics: %w", err)
+	}
+
+	var processing int64
+	if pending.Val() != nil {
+		processing = pending.Val().Count
+	}
+
+	// Acked entries are deleted, so whatever is in the stream and not pending is still queued
+	return models.QueueMetrics{
+		Queued:       length.Val() - processing,
+		Processing:   processing,
+		Retrying:     retrying.Val(),
+		DeadLettered: deadLettered.Val(),
+	}, nil
+}
+
+// Purge deletes the stream along with its consumer group, so the group is created again.
+// Entries this replica reclaimed but didn't hand out yet are dropped too.
+func (q *RedisStreamQueue) Purge(ctx context.Context) error {
+	for len(q.reclaimed) > 0 {
+		<-q.reclaimed
+	}
+	if err := q.purge(ctx); err != nil {
+		return err
+	}
+	return q.createGroup(ctx)
+}
@@ -0,0 +1,92 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"rinha-backend-arthur/internal/models"
+	"rinha-backend-arthur/internal/redistest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestRedisStreamReapKeepsEntriesPending(t *testing.T) {
+	client, keys := redistest.Client(t)
+	ctx := context.Background()
+	q, err := NewRedisStreamQueue(ctx, client, keys, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := models.QueueMessage{CorrelationId: uuid.New(), Payload: []byte(`{}`)}
+	if err := q.Enqueue(ctx, msg); err != nil {
+		t.Fatal(err)
+	}
+
+	// A worker takes the entry and dies before settling it
+	deliveries, err := q.Dequeue(ctx, 0, 1, 0)
+	if err != nil || len(deliveries) != 1 {
+		t.Fatalf("Dequeue = %v, %v", deliveries, err)
+	}
+	if deliveries[0].DeliveryCount != 1 {
+		t.Fatalf("DeliveryCount = %d, want 1", deliveries[0].DeliveryCount)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	reaped, err := q.Reap(ctx, time.Millisecond)
+	if err != nil || reaped != 1 {
+		t.Fatalf("Reap = %d, %v", reaped, err)
+	}
+
+	if length := client.XLen(ctx, q.queueKey).Val(); length != 1 {
+		t.Fatalf("stream length = %d, want 1 (no re-add)", length)
+	}
+
+	deliveries, err = q.Dequeue(ctx, 1, 10, 0)
+	if err != nil || len(deliveries) != 1 {
+		t.Fatalf("Dequeue after Reap = %v, %v", deliveries, err)
+	}
+	if got := deliveries[0]; got.Message.CorrelationId != msg.CorrelationId || got.DeliveryCount != 2 {
+		t.Fatalf("reclaimed delivery = %+v, want %s delivered twice", got, msg.CorrelationId)
+	}
+
+	if err := q.Ack(ctx, deliveries[0]); err != nil {
+		t.Fatal(err)
+	}
+	depth, err := q.Depth(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if depth.Queued != 0 || depth.Processing != 0 {
+		t.Fatalf("Depth after Ack = %+v", depth)
+	}
+}
+
+func TestAdoptLegacyStream(t *testing.T) {
+	if os.Getenv("TEST_REDIS_URL") != "" {
+		t.Skip("legacy keys have no prefix, they would clash on a shared server")
+	}
+	client, keys := redistest.Client(t)
+	ctx := context.Background()
+
+	msg := models.QueueMessage{CorrelationId: uuid.New(), Payload: []byte(`{}`)}
+	msgJSON, _ := json.Marshal(msg)
+	client.XGroupCreateMkStream(ctx, "payments:stream", paymentsStreamGroup, "0")
+	client.XAdd(ctx, &redis.XAddArgs{Stream: "payments:stream", Values: []string{streamMessageField, string(msgJSON)}})
+
+	if adopted, err := AdoptLegacyKeys(ctx, client, keys); err != nil || adopted != 1 {
+		t.Fatalf("AdoptLegacyKeys = %d, %v, want the stream moved", adopted, err)
+	}
+
+	q, err := NewRedisStreamQueue(ctx, client, keys, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deliveries, err := q.Dequeue(ctx, 0, 10, 0)
+	if err != nil || len(deliveries) != 1 || deliveries[0].Message.CorrelationId != msg.CorrelationId {
+		t.Fatalf("Dequeue = %v, %v, want the legacy stream entry", deliveries, err)
+	}
+}
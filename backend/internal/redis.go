@@ -0,0 +1,55 @@
+package internal
+
+import (
+	"fmt"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// newRedisClient connects to Redis the way RedisMode says. RedisURL is a
+// redis://[user:password@]host:port[/db][?options] URL, rediss:// for TLS:
+//   - standalone: a single server
+//   - sentinel: the URL host and any addr= options are the sentinels, master_name or
+//     REDIS_MASTER_NAME names the master, username= and password= are the master's credentials
+//   - cluster: the URL host and any addr= options are seed nodes
+//
+// Keys carry the deployment hash tag, so in a cluster they all live in one slot.
+func newRedisClient(config Config) (redis.UniversalClient, error) {
+	switch config.RedisMode {
+	case "standalone":
+		options, err := redis.ParseURL(config.RedisURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid REDIS_URL: %w", err)
+		}
+		if options.PoolSize == 0 {
+			options.PoolSize = config.RedisPoolSize
+		}
+		return redis.NewClient(options), nil
+	case "sentinel":
+		options, err := redis.ParseFailoverURL(config.RedisURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid REDIS_URL: %w", err)
+		}
+		if options.MasterName == "" {
+			options.MasterName = config.RedisMasterName
+		}
+		if options.MasterName == "" {
+			return nil, fmt.Errorf("sentinel mode needs REDIS_MASTER_NAME or a master_name option")
+		}
+		if options.PoolSize == 0 {
+			options.PoolSize = config.RedisPoolSize
+		}
+		return redis.NewFailoverClient(options), nil
+	case "cluster":
+		options, err := redis.ParseClusterURL(config.RedisURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid REDIS_URL: %w", err)
+		}
+		if options.PoolSize == 0 {
+			options.PoolSize = config.RedisPoolSize
+		}
+		return redis.NewClusterClient(options), nil
+	default:
+		return nil, fmt.Errorf("unknown REDIS_MODE %q", config.RedisMode)
+	}
+}
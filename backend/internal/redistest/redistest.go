@@ -0,0 +1,42 @@
+// Package redistest connects tests to Redis: the server at TEST_REDIS_URL when it is set,
+// an in-process miniredis otherwise. Scripts then run on miniredis' Lua, so anything that
+// depends on real Redis behaviour should also be run with TEST_REDIS_URL.
+package redistest
+
+import (
+	"context"
+	"os"
+	"rinha-backend-arthur/internal/keyspace"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+// Client returns a client and a keyspace of its own, whose keys are deleted when the test ends.
+func Client(tb testing.TB) (redis.UniversalClient, keyspace.Keyspace) {
+	tb.Helper()
+
+	url := os.Getenv("TEST_REDIS_URL")
+	if url == "" {
+		url = "redis://" + miniredis.RunT(tb).Addr()
+	}
+
+	options, err := redis.ParseURL(url)
+	if err != nil {
+		tb.Fatalf("invalid TEST_REDIS_URL: %v", err)
+	}
+	client := redis.NewClient(options)
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		tb.Fatalf("redis is not reachable at %s: %v", url, err)
+	}
+
+	keys := keyspace.New("test-" + uuid.NewString())
+	tb.Cleanup(func() {
+		keyspace.Delete(context.Background(), client, keys.Match())
+		client.Close()
+	})
+
+	return client, keys
+}
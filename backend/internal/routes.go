@@ -3,67 +3,235 @@ package internal
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 
 	"rinha-backend-arthur/internal/distributor"
 	"rinha-backend-arthur/internal/health"
+	"rinha-backend-arthur/internal/keyspace"
 	"rinha-backend-arthur/internal/models"
+	"rinha-backend-arthur/internal/outbox"
+	"rinha-backend-arthur/internal/queue"
 	"rinha-backend-arthur/internal/store"
 	"time"
 
 	"github.com/fasthttp/router"
+	"github.com/google/uuid"
 	"github.com/redis/go-redis/v9"
 	"github.com/valyala/fasthttp"
 )
 
-func CreateRouter(router *router.Router, config Config) {
+// CreateRouter registers the routes and starts the payment workers, which run until ctx is cancelled.
+// The returned shutdown waits for the workers once ctx is cancelled, then closes the store and the connections.
+func CreateRouter(ctx context.Context, router *router.Router, config Config) (shutdown func()) {
 
-	redisClient := redis.NewClient(&redis.Options{
-		Addr:     config.RedisURL,
-		Password: "",
-		DB:       0,
-		PoolSize: 50,
-	})
+	redisClient, err := newRedisClient(config)
+	if err != nil {
+		panic(fmt.Sprintf("failed to configure redis: %v", err))
+	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	pingCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
-	if err := redisClient.Ping(ctx).Err(); err != nil {
+	if err := redisClient.Ping(pingCtx).Err(); err != nil {
 		// log.Printf("Warning: Redis connection failed: %v", err)
 	}
 
-	store := &store.Store{
-		RedisClient: redisClient,
+	paymentQueue := newQueue(pingCtx, config, redisClient)
+
+	// The store outlives the workers, they still settle their claimed deliveries during shutdown
+	storeCtx, closeStore := context.WithCancel(context.WithoutCancel(ctx))
+	store := newStore(storeCtx, pingCtx, config, redisClient, paymentQueue)
+
+	paymentOutbox, err := outbox.Open(config.OutboxPath)
+	if err != nil {
+		fmt.Printf("Warning: outbox is not durable, keeping it in memory: %v\n", err)
+	} else if backlog := paymentOutbox.Backlog(); backlog > 0 {
+		fmt.Printf("Recovered %d payments from the outbox\n", backlog)
 	}
 
-	healthCheckService := health.NewHealthCheckService(store)
+	healthCheckService := health.NewHealthCheckService(store, []health.PaymentProcessorDestination{
+		processorDestination("default", config.DefaultProcessor),
+		processorDestination("fallback", config.FallbackProcessor),
+	})
 
-	newProcessor := distributor.NewPaymentProcessor(config.Workers, store, healthCheckService)
-	handler := &Handler{paymentProcessor: newProcessor}
+	newProcessor := distributor.NewPaymentProcessor(ctx, distributor.Config{
+		Workers:     config.Workers,
+		MaxAttempts: config.MaxAttempts,
+		Backoff: distributor.BackoffConfig{
+			BaseDelay: config.RetryBaseDelay,
+			MaxDelay:  config.RetryMaxDelay,
+			Jitter:    config.RetryJitter,
+		},
+		RetryPollInterval: config.RetryPollInterval,
+		VisibilityTimeout: config.VisibilityTimeout,
+		ReaperInterval:    config.ReaperInterval,
+		BatchSize:         config.QueueBatchSize,
+		BlockTimeout:      config.QueueBlockTimeout,
+		OutboxInterval:    config.OutboxInterval,
+	}, store, paymentQueue, paymentOutbox, healthCheckService)
+	handler := &Handler{paymentProcessor: newProcessor, health: healthCheckService}
 
 	router.POST("/payments", handler.HandlePayments)
+	router.GET("/payments/{correlationId}", handler.HandlePaymentStatus)
 	router.GET("/payments-summary", handler.HandlePaymentsSummary)
 	router.POST("/purge-payments", handler.HandlePurgePayments)
+	router.GET("/health", handler.HandleHealth)
+
+	router.GET("/admin/metrics", handler.HandleMetrics)
+	router.GET("/admin/queue-metrics", handler.HandleQueueMetrics)
+	router.GET("/admin/payments/export", handler.HandleExportPayments)
+	router.GET("/admin/dlq", handler.HandleListDeadLetters)
+	router.GET("/admin/dlq/{correlationId}", handler.HandleGetDeadLetter)
+	router.POST("/admin/dlq/{correlationId}/replay", handler.HandleReplayDeadLetter)
+	router.DELETE("/admin/dlq/{correlationId}", handler.HandleDiscardDeadLetter)
+
+	return func() {
+		newProcessor.Wait()
+
+		closeStore()
+		if closing, ok := store.(interface{ Done() <-chan struct{} }); ok {
+			<-closing.Done()
+		}
+
+		paymentOutbox.Close()
+		redisClient.Close()
+	}
+}
+
+func processorDestination(service string, config ProcessorConfig) health.PaymentProcessorDestination {
+	return health.PaymentProcessorDestination{
+		Service:      service,
+		BaseURL:      config.BaseURL,
+		PaymentsPath: config.PaymentsPath,
+		HealthPath:   config.HealthPath,
+		Timeout:      config.Timeout,
+		Fee:          config.Fee,
+	}
+}
+
+// newStore opens the configured store. Background loops stop with ctx, startup work is bounded by initCtx.
+func newStore(ctx, initCtx context.Context, config Config, redisClient redis.UniversalClient, paymentQueue queue.Queue) store.Store {
+	switch config.StoreBackend {
+	case "memory":
+		return store.NewMemoryStore()
+	case "postgres":
+		postgresStore, err := store.NewPostgresStore(ctx, initCtx, config.PostgresURL, config.PostgresBatchSize, config.PostgresBatchDelay)
+		if err != nil {
+			// Falling back to another store would split the payments between two ledgers
+			panic(fmt.Sprintf("failed to open postgres store: %v", err))
+		}
+		return postgresStore
+	case "log":
+		logStore, err := store.NewLogStore(ctx, config.LogStoreDir, config.LogSegmentSize, config.LogSnapshotInterval)
+		if err != nil {
+			panic(fmt.Sprintf("failed to open log store: %v", err))
+		}
+		return logStore
+	default:
+		return store.NewRedisStore(redisClient, store.RedisOptions{
+			SummaryBucketSize: config.SummaryBucketSize,
+			RangeSummary:      config.RangeSummary,
+			Keys:              keyspace.New(config.RedisKeyPrefix),
+			IdempotencyTTL:    config.IdempotencyTTL,
+			Queue:             paymentQueue,
+		})
+	}
+}
+
+func newQueue(ctx context.Context, config Config, redisClient redis.UniversalClient) queue.Queue {
+	switch config.QueueBackend {
+	case "memory":
+		return queue.NewMemoryQueue(config.QueueCapacity)
+	case "stream":
+		streamQueue, err := queue.NewRedisStreamQueue(ctx, redisClient, keyspace.New(config.RedisKeyPrefix), config.InstanceName)
+		if err != nil {
+			panic(fmt.Sprintf("failed to open stream queue: %v", err))
+		}
+		return streamQueue
+	default:
+		return queue.NewRedisListQueue(redisClient, keyspace.New(config.RedisKeyPrefix))
+	}
 }
 
 type Handler struct {
 	paymentProcessor *distributor.PaymentProcessor
+	health           *health.HealthCheckService
 }
 
+// HandlePayments enqueues a payment and answers 202 Accepted.
+// A correlationId that was already accepted is not enqueued again but also gets 202, clients resend on timeouts.
+// Accepted and settled correlationIds are remembered for IDEMPOTENCY_TTL (24h by default), a replay after
+// that is processed and counted again.
 func (h *Handler) HandlePayments(ctx *fasthttp.RequestCtx) {
 	payload := append([]byte(nil), ctx.PostBody()...)
+
+	correlationId, status, validationErr := validatePaymentPayload(payload)
+	if status != 0 {
+		sendJSONError(ctx, status, validationErr)
+		return
+	}
+
 	start := time.Now()
-	err := h.paymentProcessor.Store.RedisClient.LPush(context.Background(), "payments:queue", payload).Err()
+	msg := models.QueueMessage{
+		CorrelationId: correlationId,
+		Payload:       payload,
+	}
+	accepted, pushed, err := h.paymentProcessor.Store.AcceptPayment(context.Background(), msg)
 	if err != nil {
 		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
 		ctx.SetBodyString("Failed to enqueue payment")
 		return
 	}
+	if !accepted {
+		// A client resending after a timeout, the payment is already on its way
+		ctx.SetStatusCode(fasthttp.StatusAccepted)
+		return
+	}
+
+	if !pushed {
+		err = h.paymentProcessor.Queue.Enqueue(context.Background(), msg)
+	}
+	if err != nil {
+		h.paymentProcessor.Store.UnmarkPaymentAccepted(context.Background(), correlationId)
+		if errors.Is(err, queue.ErrQueueFull) {
+			ctx.SetStatusCode(fasthttp.StatusServiceUnavailable)
+			ctx.SetBodyString("Payment queue is full")
+			return
+		}
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		ctx.SetBodyString("Failed to enqueue payment")
+		return
+	}
+	h.paymentProcessor.Store.RecordPaymentTransition(context.Background(), correlationId, models.PaymentTransition{
+		Status: models.PaymentStatusQueued,
+	})
+
 	duration := time.Since(start)
 	fmt.Println("Payment enqueued in", duration)
 
 	ctx.SetStatusCode(fasthttp.StatusAccepted)
 }
+func (h *Handler) HandlePaymentStatus(ctx *fasthttp.RequestCtx) {
+	correlationId, ok := correlationIdFromPath(ctx)
+	if !ok {
+		return
+	}
+
+	status, err := h.paymentProcessor.Store.GetPaymentStatus(context.Background(), correlationId)
+	if err != nil {
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		ctx.SetBodyString("Failed to retrieve payment status")
+		return
+	}
+	if status == nil {
+		sendJSONError(ctx, fasthttp.StatusNotFound, models.ErrorResponse{Error: "payment not found"})
+		return
+	}
+
+	sendJSONResponse(ctx, status)
+}
+
 func (h *Handler) HandlePaymentsSummary(ctx *fasthttp.RequestCtx) {
 	fromStr := string(ctx.QueryArgs().Peek("from"))
 	toStr := string(ctx.QueryArgs().Peek("to"))
@@ -77,27 +245,14 @@ func (h *Handler) HandlePaymentsSummary(ctx *fasthttp.RequestCtx) {
 			return
 		}
 
-		payments, err := h.paymentProcessor.Store.GetPaymentsByTime(ctx, from, to)
+		summary, err := h.paymentProcessor.Store.GetPaymentSummaryByTime(ctx, from, to)
 		if err != nil {
 			ctx.SetStatusCode(fasthttp.StatusInternalServerError)
 			ctx.SetBodyString("Failed to retrieve payments")
 			return
 		}
 
-		summary := PaymentsToSummary(payments, from, to)
-
-		response := models.PaymentSummaryResponse{
-			Default: models.SummaryResponse{
-				TotalRequests: summary.Default.TotalRequests,
-				TotalAmount:   float64(summary.Default.TotalAmount) / 100.0,
-			},
-			Fallback: models.SummaryResponse{
-				TotalRequests: summary.Fallback.TotalRequests,
-				TotalAmount:   float64(summary.Fallback.TotalAmount) / 100.0,
-			},
-		}
-
-		sendJSONResponse(ctx, response)
+		sendJSONResponse(ctx, summary)
 		return
 	}
 
@@ -119,9 +274,37 @@ func (h *Handler) HandlePaymentsSummary(ctx *fasthttp.RequestCtx) {
 	}
 }
 
+// HandleHealth reports this instance as degraded while its outbox still holds unrecorded payments
+// or it has no processor to send payments to.
+func (h *Handler) HandleHealth(ctx *fasthttp.RequestCtx) {
+	backlog := h.paymentProcessor.Outbox.Backlog()
+
+	var healthyProcessor string
+	if destination := h.health.HealthyProcessor(); destination != nil {
+		healthyProcessor = destination.Service
+	}
+
+	response := models.HealthResponse{
+		Status:           "ok",
+		HealthyProcessor: healthyProcessor,
+		OutboxBacklog:    backlog,
+	}
+	if backlog > 0 || healthyProcessor == "" {
+		response.Status = "degraded"
+	}
+
+	sendJSONResponse(ctx, response)
+}
+
 func (h *Handler) HandlePurgePayments(ctx *fasthttp.RequestCtx) {
 	// Use context.Background() or create a context if needed
 	err := h.paymentProcessor.Store.PurgeAllData(context.Background())
+	if purger, ok := h.paymentProcessor.Queue.(queue.Purger); ok && err == nil {
+		err = purger.Purge(context.Background())
+	}
+	if err == nil {
+		err = h.paymentProcessor.Outbox.Purge()
+	}
 	if err != nil {
 		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
 		ctx.SetBodyString("Failed to purge payment data")
@@ -143,6 +326,27 @@ func (h *Handler) HandlePurgePayments(ctx *fasthttp.RequestCtx) {
 	}
 }
 
+// correlationIdFromPath parses the {correlationId} route parameter, answering 400 when it isn't a UUID.
+func correlationIdFromPath(ctx *fasthttp.RequestCtx) (uuid.UUID, bool) {
+	correlationIdStr, _ := ctx.UserValue("correlationId").(string)
+	correlationId, err := uuid.Parse(correlationIdStr)
+	if err != nil {
+		sendJSONError(ctx, fasthttp.StatusBadRequest, models.ErrorResponse{
+			Error:  "invalid correlationId",
+			Fields: []models.FieldError{{Field: "correlationId", Message: "must be a valid UUID"}},
+		})
+		return uuid.Nil, false
+	}
+	return correlationId, true
+}
+
+func sendJSONError(ctx *fasthttp.RequestCtx, status int, response interface{}) {
+	sendJSONResponse(ctx, response)
+	if ctx.Response.StatusCode() == fasthttp.StatusOK {
+		ctx.SetStatusCode(status)
+	}
+}
+
 func sendJSONResponse(ctx *fasthttp.RequestCtx, response interface{}) {
 	ctx.SetContentType("application/json")
 	ctx.SetStatusCode(fasthttp.StatusOK)
@@ -0,0 +1,317 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"rinha-backend-arthur/internal/models"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Settled payments are also counted per processor in fixed-size time buckets, so a ranged summary
+// adds up the buckets fully inside the range and only scans the payments of the two partial ones.
+const bucketFieldsPerCall = 1000
+
+// bucketOf returns the bucket holding a requestedAt in unix nanoseconds.
+// Bucket b covers [b*size, (b+1)*size).
+func (s *RedisStore) bucketOf(requestedAt int64) int64 {
+	return floorDiv(requestedAt, s.bucketSize.Nanoseconds())
+}
+
+func floorDiv(a, b int64) int64 {
+	q := a / b
+	if a%b != 0 && (a < 0) != (b < 0) {
+		q--
+	}
+	return q
+}
+
+func (s *RedisStore) GetPaymentSummaryByTime(ctx context.Context, from, to time.Time) (models.PaymentSummaryResponse, error) {
+	switch s.rangeSummary {
+	case RangeSummaryLua:
+		return s.luaSummary(ctx, from, to)
+	case RangeSummaryScan:
+		payments, err := s.GetPaymentsByTime(ctx, from, to)
+		if err != nil {
+			return models.PaymentSummaryResponse{}, err
+		}
+		return summarizePayments(payments), nil
+	default:
+		return s.bucketSummary(ctx, from, to)
+	}
+}
+
+func (s *RedisStore) bucketSummary(ctx context.Context, from, to time.Time) (models.PaymentSummaryResponse, error) {
+	fromNs, toNs := from.UnixNano(), to.UnixNano()
+	if fromNs > toNs {
+		return models.PaymentSummaryResponse{}, nil
+	}
+
+	complete, err := s.bucketsAreComplete(ctx)
+	if err != nil {
+		return models.PaymentSummaryResponse{}, err
+	}
+	if !complete {
+		// Payments from before the buckets existed aren't in them until the migrate command backfills them
+		return s.scanSummary(ctx, fromNs, toNs)
+	}
+
+	size := s.bucketSize.Nanoseconds()
+	firstFull := floorDiv(fromNs-1, size) + 1 // first bucket starting at or after from
+	lastFull := floorDiv(toNs+1, size) - 1    // last bucket ending at or before to
+
+	if firstFull > lastFull {
+		// The range sits inside at most two buckets, scanning it is cheap
+		return s.scanSummary(ctx, fromNs, toNs)
+	}
+
+	// Only the buckets between the oldest and newest payment can hold anything, and reading more
+	// buckets than there are payments in the range costs more than scanning them
+	oldest, newest, count, err := s.storedBuckets(ctx, fromNs, toNs)
+	if err != nil {
+		return models.PaymentSummaryResponse{}, err
+	}
+	first, last := max(firstFull, oldest), min(lastFull, newest)
+	if last-first+1 > count {
+		return s.scanSummary(ctx, fromNs, toNs)
+	}
+
+	var summary models.PaymentSummaryResponse
+	if first <= last {
+		if summary, err = s.sumBuckets(ctx, first, last); err != nil {
+			return models.PaymentSummaryResponse{}, err
+		}
+	}
+
+	if fromNs < firstFull*size {
+		edge, err := s.scanSummary(ctx, fromNs, firstFull*size-1)
+		if err != nil {
+			return models.PaymentSummaryResponse{}, err
+		}
+		summary = addSummaries(summary, edge)
+	}
+	if toNs >= (lastFull+1)*size {
+		edge, err := s.scanSummary(ctx, (lastFull+1)*size, toNs)
+		if err != nil {
+			return models.PaymentSummaryResponse{}, err
+		}
+		summary = addSummaries(summary, edge)
+	}
+
+	return summary, nil
+}
+
+// storedBuckets returns the buckets of the oldest and newest stored payment and how many payments
+// score between fromNs and toNs. With no payments the oldest bucket is after the newest.
+func (s *RedisStore) storedBuckets(ctx context.Context, fromNs, toNs int64) (int64, int64, int64, error) {
+	minScore, maxScore := paymentScoreRange(time.Unix(0, fromNs-bucketScoreSlack), time.Unix(0, toNs+bucketScoreSlack))
+	pipe := s.client.Pipeline()
+	oldest := pipe.ZRangeWithScores(ctx, s.keys.payments, 0, 0)
+	newest := pipe.ZRangeWithScores(ctx, s.keys.payments, -1, -1)
+	count := pipe.ZCount(ctx, s.keys.payments, minScore, maxScore)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, 0, 0, fmt.Errorf("failed to read the payments range: %w", err)
+	}
+
+	if len(oldest.Val()) == 0 || len(newest.Val()) == 0 {
+		return 1, 0, 0, nil
+	}
+	return s.bucketOf(int64(oldest.Val()[0].Score) - bucketScoreSlack),
+		s.bucketOf(int64(newest.Val()[0].Score) + bucketScoreSlack),
+		count.Val(), nil
+}
+
+func (s *RedisStore) sumBuckets(ctx context.Context, first, last int64) (models.PaymentSummaryResponse, error) {
+	var summary models.PaymentSummaryResponse
+
+	for start := first; start <= last; start += bucketFieldsPerCall / 2 {
+		end := min(start+bucketFieldsPerCall/2-1, last)
+
+		fields := make([]string, 0, 2*(end-start+1))
+		for bucket := start; bucket <= end; bucket++ {
+			b := strconv.FormatInt(bucket, 10)
+			fields = append(fields, b+":count", b+":amount")
+		}
+
+		pipe := s.client.Pipeline()
+		defaultValues := pipe.HMGet(ctx, s.keys.buckets(s.bucketSize, "default"), fields...)
+		fallbackValues := pipe.HMGet(ctx, s.keys.buckets(s.bucketSize, "fallback"), fields...)
+		if _, err := pipe.Exec(ctx); err != nil {
+			return models.PaymentSummaryResponse{}, fmt.Errorf("failed to retrieve summary buckets: %w", err)
+		}
+
+		addBucketValues(&summary.Default, defaultValues.Val())
+		addBucketValues(&summary.Fallback, fallbackValues.Val())
+	}
+
+	return summary, nil
+}
+
+// addBucketValues adds HMGET results laid out as count, amount pairs.
+func addBucketValues(summary *models.SummaryResponse, values []any) {
+	for i := 0; i+1 < len(values); i += 2 {
+		count, _ := values[i].(string)
+		amount, _ := values[i+1].(string)
+		c, _ := strconv.ParseInt(count, 10, 64)
+		a, _ := strconv.ParseInt(amount, 10, 64)
+		summary.TotalRequests += c
+		summary.TotalAmount += models.Money(a)
+	}
+}
+
+// scanSummary sums the payments between from and to, in unix nanoseconds, from the payments set.
+// Scores are float64 and lose precision at nanosecond scale, so the exact requestedAt decides.
+func (s *RedisStore) scanSummary(ctx context.Context, fromNs, toNs int64) (models.PaymentSummaryResponse, error) {
+	payments, err := s.GetPaymentsByTime(ctx, time.Unix(0, fromNs), time.Unix(0, toNs))
+	if err != nil {
+		return models.PaymentSummaryResponse{}, err
+	}
+
+	inRange := payments[:0]
+	for _, payment := range payments {
+		requestedAt := payment.RequestedAt.UnixNano()
+		if requestedAt >= fromNs && requestedAt <= toNs {
+			inRange = append(inRange, payment)
+		}
+	}
+
+	return summarizePayments(inRange), nil
+}
+
+func addSummaries(a, b models.PaymentSummaryResponse) models.PaymentSummaryResponse {
+	a.Default.TotalRequests += b.Default.TotalRequests
+	a.Default.TotalAmount += b.Default.TotalAmount
+	a.Fallback.TotalRequests += b.Fallback.TotalRequests
+	a.Fallback.TotalAmount += b.Fallback.TotalAmount
+	return a
+}
+
+func (s *RedisStore) bucketsAreComplete(ctx context.Context) (bool, error) {
+	if s.bucketsComplete.Load() {
+		return true, nil
+	}
+
+	n, err := s.client.Exists(ctx, s.keys.bucketsComplete(s.bucketSize)).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to check summary buckets: %w", err)
+	}
+	if n == 1 {
+		s.bucketsComplete.Store(true)
+	}
+	return n == 1, nil
+}
+
+// bucketScoreSlack widens a bucket's score range past the float64 rounding of nanosecond scores,
+// the exact requestedAt in the record decides which bucket a payment belongs to.
+const bucketScoreSlack = int64(time.Microsecond)
+
+// maxBucketAttempts bounds how often a bucket is recomputed while payments keep landing in it.
+const maxBucketAttempts = 10
+
+// setBucketScript overwrites a bucket with totals computed from the payments set, unless payments
+// were added to its score range since they were read. Settling increments the bucket in the same
+// script that adds the payment, so once written the bucket stays exact.
+//
+// KEYS: payments set, default buckets hash, fallback buckets hash
+// ARGV: min score, max score, members read, bucket, default count, default amount, fallback count, fallback amount
+var setBucketScript = redis.NewScript(`
+if redis.call('ZCOUNT', KEYS[1], ARGV[1], ARGV[2]) ~= tonumber(ARGV[3]) then
+	return 0
+end
+redis.call('HSET', KEYS[2], ARGV[4] .. ':count', ARGV[5], ARGV[4] .. ':amount', ARGV[6])
+redis.call('HSET', KEYS[3], ARGV[4] .. ':count', ARGV[7], ARGV[4] .. ':amount', ARGV[8])
+return 1
+`)
+
+// BackfillSummaries rebuilds every bucket of the configured size from the payments set, then
+// marks the buckets complete so ranged summaries use them. It is safe to run while payments
+// are being settled, and to run again.
+func (s *RedisStore) BackfillSummaries(ctx context.Context) (int, error) {
+	size := s.bucketSize.Nanoseconds()
+	var backfilled int
+	var last int64
+	next := "-inf"
+
+	for {
+		first, err := s.client.ZRangeByScoreWithScores(ctx, s.keys.payments, &redis.ZRangeBy{
+			Min: next, Max: "+inf", Count: 1,
+		}).Result()
+		if err != nil {
+			return backfilled, fmt.Errorf("failed to scan payments: %w", err)
+		}
+		if len(first) == 0 {
+			break
+		}
+
+		requestedAt := int64(first[0].Score)
+		if member, ok := first[0].Member.(string); ok {
+			if payment, err := models.DecodePaymentRecord([]byte(member)); err == nil {
+				requestedAt = payment.RequestedAt.UnixNano()
+			}
+		}
+		bucket := floorDiv(requestedAt, size)
+		if backfilled > 0 && bucket <= last {
+			bucket = last + 1
+		}
+
+		if err := s.backfillBucket(ctx, bucket); err != nil {
+			return backfilled, err
+		}
+		backfilled++
+		last = bucket
+
+		// The next bucket's payments may score slightly below its start
+		next = fmt.Sprintf("%f", float64((bucket+1)*size-bucketScoreSlack))
+	}
+
+	if err := s.client.Set(ctx, s.keys.bucketsComplete(s.bucketSize), "1", 0).Err(); err != nil {
+		return backfilled, fmt.Errorf("failed to mark summary buckets complete: %w", err)
+	}
+	s.bucketsComplete.Store(true)
+
+	return backfilled, nil
+}
+
+func (s *RedisStore) backfillBucket(ctx context.Context, bucket int64) error {
+	size := s.bucketSize.Nanoseconds()
+	fromNs, toNs := bucket*size, (bucket+1)*size-1
+	minScore := fmt.Sprintf("%f", float64(fromNs-bucketScoreSlack))
+	maxScore := fmt.Sprintf("%f", float64(toNs+bucketScoreSlack))
+
+	for range maxBucketAttempts {
+		members, err := s.client.ZRangeByScore(ctx, s.keys.payments, &redis.ZRangeBy{Min: minScore, Max: maxScore}).Result()
+		if err != nil {
+			return fmt.Errorf("failed to scan payments: %w", err)
+		}
+
+		var payments []models.Payment
+		for _, member := range members {
+			payment, err := models.DecodePaymentRecord([]byte(member))
+			if err != nil {
+				continue // Not counted by summaries either
+			}
+			if requestedAt := payment.RequestedAt.UnixNano(); requestedAt < fromNs || requestedAt > toNs {
+				continue
+			}
+			payments = append(payments, payment)
+		}
+		summary := summarizePayments(payments)
+
+		set, err := setBucketScript.Run(ctx, s.client,
+			[]string{s.keys.payments, s.keys.buckets(s.bucketSize, "default"), s.keys.buckets(s.bucketSize, "fallback")},
+			minScore, maxScore, len(members), bucket,
+			summary.Default.TotalRequests, summary.Default.TotalAmount.Cents(),
+			summary.Fallback.TotalRequests, summary.Fallback.TotalAmount.Cents(),
+		).Int()
+		if err != nil {
+			return fmt.Errorf("failed to backfill summary bucket %d: %w", bucket, err)
+		}
+		if set == 1 {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("failed to backfill summary bucket %d: payments kept arriving", bucket)
+}
@@ -0,0 +1,125 @@
+package store
+
+import (
+	"context"
+	"rinha-backend-arthur/internal/models"
+	"rinha-backend-arthur/internal/redistest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestBackfillSummaries(t *testing.T) {
+	client, keys := redistest.Client(t)
+	ctx := context.Background()
+	s := NewRedisStore(client, RedisOptions{
+		SummaryBucketSize: time.Second,
+		RangeSummary:      RangeSummaryBuckets,
+		Keys:              keys,
+		IdempotencyTTL:    time.Hour,
+	})
+
+	base := time.Date(2025, 7, 1, 12, 0, 0, 0, time.UTC)
+	for i := range 50 {
+		service := "default"
+		if i%3 == 0 {
+			service = "fallback"
+		}
+		payment := models.Payment{
+			PaymentRequest: models.PaymentRequest{
+				CorrelationId: uuid.New(),
+				Amount:        models.Money(100 + i),
+				RequestedAt:   base.Add(time.Duration(i) * 170 * time.Millisecond),
+			},
+			Service: service,
+		}
+		if err := s.StorePayment(ctx, payment); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	from, to := base.Add(300*time.Millisecond), base.Add(7*time.Second)
+	want, err := s.scanSummary(ctx, from.UnixNano(), to.UnixNano())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Payments stored before the buckets existed
+	client.Del(ctx, s.keys.buckets(time.Second, "default"), s.keys.buckets(time.Second, "fallback"), s.keys.bucketsComplete(time.Second))
+	legacy := NewRedisStore(client, RedisOptions{SummaryBucketSize: time.Second, RangeSummary: RangeSummaryBuckets, Keys: keys})
+
+	if got, err := legacy.GetPaymentSummaryByTime(ctx, from, to); err != nil || got != want {
+		t.Fatalf("summary before backfill = %+v, %v, want %+v", got, err, want)
+	}
+
+	if _, err := legacy.BackfillSummaries(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := legacy.bucketSummary(ctx, from, to); err != nil || got != want {
+		t.Fatalf("summary from backfilled buckets = %+v, %v, want %+v", got, err, want)
+	}
+
+	// Another size has buckets of its own, empty until backfilled
+	resized := NewRedisStore(client, RedisOptions{SummaryBucketSize: 2 * time.Second, RangeSummary: RangeSummaryBuckets, Keys: keys})
+	if got, err := resized.GetPaymentSummaryByTime(ctx, from, to); err != nil || got != want {
+		t.Fatalf("summary with another bucket size = %+v, %v, want %+v", got, err, want)
+	}
+	if _, err := resized.BackfillSummaries(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := resized.bucketSummary(ctx, from, to); err != nil || got != want {
+		t.Fatalf("summary from resized buckets = %+v, %v, want %+v", got, err, want)
+	}
+}
+
+// A wide range must cost what is stored in it, not one bucket per second of it.
+func TestBucketSummaryOfDecades(t *testing.T) {
+	client, keys := redistest.Client(t)
+	ctx := context.Background()
+	s := NewRedisStore(client, RedisOptions{
+		SummaryBucketSize: time.Second,
+		RangeSummary:      RangeSummaryBuckets,
+		Keys:              keys,
+		IdempotencyTTL:    time.Hour,
+	})
+	if err := s.PurgeAllData(ctx); err != nil { // marks the buckets complete
+		t.Fatal(err)
+	}
+
+	// Payments decades apart, so clamping to the stored ones still spans them
+	for i, requestedAt := range []time.Time{
+		time.Date(2001, 3, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(2025, 7, 1, 12, 0, 0, 0, time.UTC),
+		time.Date(2025, 7, 1, 12, 0, 1, 500, time.UTC),
+	} {
+		payment := models.Payment{
+			PaymentRequest: models.PaymentRequest{CorrelationId: uuid.New(), Amount: models.Money(100 * (i + 1)), RequestedAt: requestedAt},
+			Service:        "default",
+		}
+		if err := s.StorePayment(ctx, payment); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, r := range []struct{ from, to time.Time }{
+		{time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 7, 1, 12, 0, 1, 0, time.UTC)},
+		{time.Date(2025, 7, 1, 12, 0, 0, 0, time.UTC), time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(1999, 1, 1, 0, 0, 0, 0, time.UTC)},
+	} {
+		want, err := s.scanSummary(ctx, r.from.UnixNano(), r.to.UnixNano())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		start := time.Now()
+		got, err := s.bucketSummary(ctx, r.from, r.to)
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Fatalf("summary of %v to %v took %v", r.from, r.to, elapsed)
+		}
+		if err != nil || got != want {
+			t.Fatalf("summary of %v to %v = %+v, %v, want %+v", r.from, r.to, got, err, want)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"rinha-backend-arthur/internal/models"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const streamChunkSize = 1000
+
+// StreamPayments pages through the payments set by score. Each page starts at the last score
+// seen and skips the members of that score already returned, so payments settled while the
+// export runs don't shift the pages the way rank offsets would.
+func (s *RedisStore) StreamPayments(ctx context.Context, from, to time.Time, yield func(models.Payment) error) error {
+	// Deployments from before the payments set kept a hash, until it is migrated
+	keyType, err := s.client.Type(ctx, s.keys.payments).Result()
+	if err != nil {
+		return fmt.Errorf("failed to retrieve payments: %w", err)
+	}
+	if keyType == "hash" {
+		return s.streamPaymentsHash(ctx, from, to, yield)
+	}
+
+	minScore, maxScore := "-inf", "+inf"
+	minValue := math.Inf(-1)
+	if !from.IsZero() {
+		minValue = float64(from.UnixNano())
+		minScore = strconv.FormatFloat(minValue, 'f', -1, 64)
+	}
+	if !to.IsZero() {
+		maxScore = fmt.Sprintf("%f", float64(to.UnixNano()))
+	}
+
+	// Scores are float64 and lose precision at nanosecond scale, so the exact requestedAt decides
+	exactFrom, exactTo := openRange(from, to)
+
+	var seenAtMin int64
+	for {
+		entries, err := s.client.ZRangeByScoreWithScores(ctx, s.keys.payments, &redis.ZRangeBy{
+			Min:    minScore,
+			Max:    maxScore,
+			Offset: seenAtMin,
+			Count:  streamChunkSize,
+		}).Result()
+		if err != nil {
+			return fmt.Errorf("failed to retrieve payments: %w", err)
+		}
+
+		for _, entry := range entries {
+			if err := yieldPaymentRecord(entry.Member, exactFrom, exactTo, yield); err != nil {
+				return err
+			}
+		}
+
+		if len(entries) < streamChunkSize {
+			return nil
+		}
+
+		// Restart from the last score, past the members with that score already returned
+		lastScore := entries[len(entries)-1].Score
+		sameScore := int64(0)
+		for i := len(entries) - 1; i >= 0 && entries[i].Score == lastScore; i-- {
+			sameScore++
+		}
+		if lastScore == minValue {
+			seenAtMin += sameScore
+		} else {
+			minValue, seenAtMin = lastScore, sameScore
+			minScore = strconv.FormatFloat(lastScore, 'f', -1, 64)
+		}
+	}
+}
+
+// streamPaymentsHash walks a legacy payments hash with HSCAN. It isn't ordered by time.
+func (s *RedisStore) streamPaymentsHash(ctx context.Context, from, to time.Time, yield func(models.Payment) error) error {
+	from, to = openRange(from, to)
+
+	var cursor uint64
+	for {
+		// HSCAN returns field, value pairs
+		entries, next, err := s.client.HScan(ctx, s.keys.payments, cursor, "", streamChunkSize).Result()
+		if err != nil {
+			return fmt.Errorf("failed to retrieve payments: %w", err)
+		}
+
+		for i := 1; i < len(entries); i += 2 {
+			payment, err := models.DecodePaymentRecord([]byte(entries[i]))
+			if err != nil || payment.RequestedAt.Before(from) || payment.RequestedAt.After(to) {
+				continue
+			}
+			if err := yield(payment); err != nil {
+				return err
+			}
+		}
+
+		cursor = next
+		if cursor == 0 {
+			return nil
+		}
+	}
+}
+
+// streamPages yields the payments of an ordered store page by page. page returns at most
+// streamChunkSize payments requested from from on, past the first skip of them. Like the Redis
+// pages, each one restarts at the last requestedAt seen, so payments stored meanwhile don't shift them.
+func streamPages(ctx context.Context, from time.Time, yield func(models.Payment) error, page func(from time.Time, skip int) []models.Payment) error {
+	skip := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		payments := page(from, skip)
+		for _, payment := range payments {
+			if err := yield(payment); err != nil {
+				return err
+			}
+		}
+
+		if len(payments) < streamChunkSize {
+			return nil
+		}
+
+		last := payments[len(payments)-1].RequestedAt
+		sameTime := 0
+		for i := len(payments) - 1; i >= 0 && payments[i].RequestedAt.Equal(last); i-- {
+			sameTime++
+		}
+		if last.Equal(from) {
+			skip += sameTime
+		} else {
+			from, skip = last, sameTime
+		}
+	}
+}
+
+func yieldPaymentRecord(member any, from, to time.Time, yield func(models.Payment) error) error {
+	record, _ := member.(string)
+	payment, err := models.DecodePaymentRecord([]byte(record))
+	if err != nil {
+		return nil // Skip invalid data
+	}
+	if payment.RequestedAt.Before(from) || payment.RequestedAt.After(to) {
+		return nil
+	}
+	return yield(payment)
+}
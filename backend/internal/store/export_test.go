@@ -0,0 +1,132 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"rinha-backend-arthur/internal/models"
+	"rinha-backend-arthur/internal/redistest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// TestStreamPaymentsPages streams more than a page of payments sharing requestedAt values,
+// storing more while it runs, which needs the store to be unlocked while yield is called.
+func TestStreamPaymentsPages(t *testing.T) {
+	logStore, err := NewLogStore(t.Context(), t.TempDir(), 1<<20, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, keys := redistest.Client(t)
+
+	stores := map[string]Store{
+		"memory": NewMemoryStore(),
+		"log":    logStore,
+		"redis":  NewRedisStore(client, RedisOptions{SummaryBucketSize: time.Second, Keys: keys, IdempotencyTTL: time.Hour}),
+	}
+
+	base := time.Date(2025, 7, 1, 12, 0, 0, 0, time.UTC)
+	for name, s := range stores {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			want := map[uuid.UUID]bool{}
+			store := func(requestedAt time.Time) {
+				payment := models.Payment{
+					PaymentRequest: models.PaymentRequest{CorrelationId: uuid.New(), Amount: 100, RequestedAt: requestedAt},
+					Service:        "default",
+				}
+				if err := s.StorePayment(ctx, payment); err != nil {
+					t.Fatal(err)
+				}
+				want[payment.CorrelationId] = true
+			}
+
+			// Whole pages of a single requestedAt, then distinct ones
+			for i := range 2*streamChunkSize + 10 {
+				store(base.Add(time.Duration(i/(streamChunkSize+5)) * time.Second))
+			}
+			for i := range streamChunkSize {
+				store(base.Add(time.Hour + time.Duration(i)*time.Millisecond))
+			}
+
+			seen := map[uuid.UUID]bool{}
+			var last time.Time
+			err := s.StreamPayments(ctx, time.Time{}, time.Time{}, func(payment models.Payment) error {
+				if seen[payment.CorrelationId] {
+					t.Fatalf("payment %s streamed twice", payment.CorrelationId)
+				}
+				if payment.RequestedAt.Before(last) {
+					t.Fatalf("payment at %v streamed after %v", payment.RequestedAt, last)
+				}
+				seen[payment.CorrelationId], last = true, payment.RequestedAt
+
+				// Later than anything streamed so far, so it is streamed too
+				if len(seen) == streamChunkSize/2 {
+					store(base.Add(2 * time.Hour))
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(seen) != len(want) {
+				t.Fatalf("streamed %d payments, want %d", len(seen), len(want))
+			}
+
+			// A range starting exactly at a requestedAt shared by more than a page
+			var inRange int
+			err = s.StreamPayments(ctx, base, base.Add(time.Hour-time.Nanosecond), func(payment models.Payment) error {
+				inRange++
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if inRange != 2*streamChunkSize+10 {
+				t.Fatalf("streamed %d payments from %v, want %d", inRange, base, 2*streamChunkSize+10)
+			}
+		})
+	}
+}
+
+// TestStreamPaymentsLegacyHash streams a payments hash left by a deployment from before the
+// payments set, as long as nothing was settled since to move it aside.
+func TestStreamPaymentsLegacyHash(t *testing.T) {
+	client, keys := redistest.Client(t)
+	ctx := context.Background()
+	s := NewRedisStore(client, RedisOptions{SummaryBucketSize: time.Second, Keys: keys, IdempotencyTTL: time.Hour})
+
+	base := time.Date(2025, 7, 1, 12, 0, 0, 0, time.UTC)
+	want := map[uuid.UUID]bool{}
+	for i := range 2*streamChunkSize + 10 {
+		id := uuid.New()
+		client.HSet(ctx, s.keys.payments, id.String(), fmt.Sprintf(`{"correlationId":%q,"amount":150,"paymentProcessor":"default","requestedAt":%q}`,
+			id, base.Add(time.Duration(i)*time.Second).Format(time.RFC3339Nano)))
+		if i >= 10 && i < 20 {
+			want[id] = true
+		}
+	}
+	client.HSet(ctx, s.keys.payments, "broken", "{")
+
+	got := map[uuid.UUID]bool{}
+	err := s.StreamPayments(ctx, base.Add(10*time.Second), base.Add(19*time.Second), func(payment models.Payment) error {
+		if payment.Amount != 150 {
+			t.Fatalf("payment %s streamed with amount %v, want 1.50", payment.CorrelationId, payment.Amount)
+		}
+		got[payment.CorrelationId] = true
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("streamed %d payments, want %d", len(got), len(want))
+	}
+	for id := range want {
+		if !got[id] {
+			t.Fatalf("payment %s in the range was not streamed", id)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package store
+
+import (
+	"context"
+	"rinha-backend-arthur/internal/keyspace"
+	"time"
+)
+
+func (s *RedisStore) AcquireLock(ctx context.Context, name string, ttl time.Duration) (string, error) {
+	return keyspace.AcquireLock(ctx, s.client, s.keys.lock(name), ttl)
+}
+
+func (s *RedisStore) ReleaseLock(ctx context.Context, name string, token string) error {
+	return keyspace.ReleaseLock(ctx, s.client, s.keys.lock(name), token)
+}
+
+func (s *RedisStore) SetHealthyProcessor(ctx context.Context, service string) error {
+	healthData := map[string]any{
+		"service":   service,
+		"timestamp": time.Now().Unix(),
+	}
+	return s.client.HSet(ctx, s.keys.healthyProcessor, healthData).Err()
+}
+
+func (s *RedisStore) GetHealthyProcessor(ctx context.Context) (string, error) {
+	healthData, err := s.client.HGetAll(ctx, s.keys.healthyProcessor).Result()
+	if err != nil {
+		return "", err
+	}
+	return healthData["service"], nil
+}
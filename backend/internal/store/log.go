@@ -0,0 +1,150 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"rinha-backend-arthur/internal/models"
+	"rinha-backend-arthur/internal/queue"
+	"rinha-backend-arthur/internal/store/logstore"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// LogStore keeps settled payments in an embedded append-only log on local disk, for single instance
+// deployments without Redis. Lifecycle, metrics and health state are only kept in memory.
+// It can't apply queue acks, SettlePayment always leaves them to the caller.
+type LogStore struct {
+	*MemoryStore
+	log  *logstore.Log
+	done chan struct{} // closed once the snapshot loop stopped and the log is closed
+}
+
+// NewLogStore opens the log in dir, recovering what a previous run left, and snapshots it
+// every snapshotInterval while segments were sealed. When ctx is cancelled the log is closed.
+func NewLogStore(ctx context.Context, dir string, segmentSize int64, snapshotInterval time.Duration) (*LogStore, error) {
+	log, err := logstore.Open(logstore.Options{
+		Dir:         dir,
+		SegmentSize: segmentSize,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open payment log: %w", err)
+	}
+
+	s := &LogStore{
+		MemoryStore: NewMemoryStore(),
+		log:         log,
+		done:        make(chan struct{}),
+	}
+
+	go s.snapshotLoop(ctx, snapshotInterval)
+
+	return s, nil
+}
+
+func (s *LogStore) snapshotLoop(ctx context.Context, interval time.Duration) {
+	defer close(s.done)
+	defer s.log.Close()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if s.log.SealedSegments() == 0 {
+			continue
+		}
+		if err := s.log.Snapshot(); err != nil {
+			fmt.Printf("[Log] Failed to snapshot payments: %v\n", err)
+		}
+	}
+}
+
+// Done is closed once the log is closed after the ctx given to NewLogStore was cancelled.
+func (s *LogStore) Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *LogStore) IsPaymentSettled(ctx context.Context, correlationId uuid.UUID) (bool, error) {
+	return s.log.Contains(correlationId), nil
+}
+
+func (s *LogStore) StorePayment(ctx context.Context, payment models.Payment) error {
+	_, err := s.SettlePayment(ctx, payment, queue.Delivery{})
+	return err
+}
+
+func (s *LogStore) SettlePayment(ctx context.Context, payment models.Payment, delivery queue.Delivery) (bool, error) {
+	appended, err := s.log.Append(logstore.Record{
+		CorrelationId: payment.CorrelationId,
+		AmountCents:   payment.Amount.Cents(),
+		Processor:     payment.Service,
+		RequestedAt:   payment.RequestedAt.UnixNano(),
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to store payment: %w", err)
+	}
+	if !appended {
+		return false, ErrPaymentAlreadyStored
+	}
+	return false, nil
+}
+
+func (s *LogStore) GetPaymentSummaryDirect(ctx context.Context) (models.PaymentSummaryResponse, error) {
+	return summaryFromTotals(s.log.Totals()), nil
+}
+
+func (s *LogStore) GetPaymentSummaryByTime(ctx context.Context, from, to time.Time) (models.PaymentSummaryResponse, error) {
+	return summaryFromTotals(s.log.RangeTotals(from.UnixNano(), to.UnixNano())), nil
+}
+
+func summaryFromTotals(totals map[string]logstore.Totals) models.PaymentSummaryResponse {
+	return models.PaymentSummaryResponse{
+		Default: models.SummaryResponse{
+			TotalRequests: totals["default"].Count,
+			TotalAmount:   models.Money(totals["default"].AmountCents),
+		},
+		Fallback: models.SummaryResponse{
+			TotalRequests: totals["fallback"].Count,
+			TotalAmount:   models.Money(totals["fallback"].AmountCents),
+		},
+	}
+}
+
+func (s *LogStore) GetPaymentsByTime(ctx context.Context, from, to time.Time) ([]models.Payment, error) {
+	return paymentsFromRecords(s.log.Range(from.UnixNano(), to.UnixNano())), nil
+}
+
+func (s *LogStore) StreamPayments(ctx context.Context, from, to time.Time, yield func(models.Payment) error) error {
+	from, to = openRange(from, to)
+	return streamPages(ctx, from, yield, func(from time.Time, skip int) []models.Payment {
+		return paymentsFromRecords(s.log.RangePage(from.UnixNano(), to.UnixNano(), skip, streamChunkSize))
+	})
+}
+
+func paymentsFromRecords(records []logstore.Record) []models.Payment {
+	payments := make([]models.Payment, 0, len(records))
+	for _, record := range records {
+		payments = append(payments, models.Payment{
+			PaymentRequest: models.PaymentRequest{
+				CorrelationId: record.CorrelationId,
+				Amount:        models.Money(record.AmountCents),
+				RequestedAt:   time.Unix(0, record.RequestedAt).UTC(),
+			},
+			Service: record.Processor,
+		})
+	}
+	return payments
+}
+
+func (s *LogStore) PurgeAllData(ctx context.Context) error {
+	if err := s.log.Purge(); err != nil {
+		return fmt.Errorf("failed to purge payment log: %w", err)
+	}
+	return s.MemoryStore.PurgeAllData(ctx)
+}
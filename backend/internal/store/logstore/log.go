@@ -0,0 +1,363 @@
+// Package logstore is an embedded, append-only ledger of settled payments.
+//
+// Records are appended to numbered segment files and indexed in memory by requestedAt.
+// Snapshot writes the whole index to a snapshot file and deletes the segments it covers,
+// which bounds disk usage to one snapshot plus the segments written since.
+// Open recovers the index from the latest snapshot and the segments after it.
+package logstore
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+type Options struct {
+	Dir         string
+	SegmentSize int64 // a segment is sealed once it grows past this size
+}
+
+type Totals struct {
+	Count       int64
+	AmountCents int64
+}
+
+type Log struct {
+	dir         string
+	segmentSize int64
+
+	snapshotMu sync.Mutex // serializes Snapshot and Purge
+
+	mu                  sync.RWMutex
+	active              *os.File
+	activeID            uint64
+	activeSize          int64
+	records             []Record // ordered by RequestedAt
+	ids                 map[uuid.UUID]bool
+	totals              map[string]Totals
+	sealedSinceSnapshot int
+}
+
+func Open(options Options) (*Log, error) {
+	if err := os.MkdirAll(options.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create log directory: %w", err)
+	}
+
+	l := &Log{
+		dir:         options.Dir,
+		segmentSize: options.SegmentSize,
+	}
+	l.reset()
+
+	if err := l.recover(); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+func (l *Log) reset() {
+	l.records = nil
+	l.ids = make(map[uuid.UUID]bool)
+	l.totals = make(map[string]Totals)
+	l.sealedSinceSnapshot = 0
+}
+
+// recover rebuilds the index from the newest snapshot and the segments after it,
+// then opens the last segment for appending.
+func (l *Log) recover() error {
+	snapshots, err := listFiles(l.dir, snapshotExtension)
+	if err != nil {
+		return fmt.Errorf("failed to list snapshots: %w", err)
+	}
+
+	var firstSegment uint64
+	if len(snapshots) > 0 {
+		// Snapshots are only installed complete and the segments they cover are gone, so falling
+		// back to an older one would silently lose payments
+		newest := snapshots[len(snapshots)-1]
+		records, err := readSnapshot(snapshotPath(l.dir, newest))
+		if err != nil {
+			return fmt.Errorf("snapshot %d is unreadable, refusing to start with a partial ledger: %w", newest, err)
+		}
+		for _, record := range records {
+			l.index(record)
+		}
+		firstSegment = newest
+	}
+
+	segments, err := listFiles(l.dir, segmentExtension)
+	if err != nil {
+		return fmt.Errorf("failed to list segments: %w", err)
+	}
+
+	l.activeID = firstSegment
+	for i, id := range segments {
+		if id < firstSegment {
+			continue // Already in the snapshot, compaction didn't get to delete it
+		}
+
+		last := i == len(segments)-1
+		size, err := replaySegment(segmentPath(l.dir, id), last, l.index)
+		if err != nil {
+			return err
+		}
+		l.activeID, l.activeSize = id, size
+		if !last {
+			l.sealedSinceSnapshot++
+		}
+	}
+
+	return l.openActive()
+}
+
+func (l *Log) openActive() error {
+	file, err := os.OpenFile(segmentPath(l.dir, l.activeID), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open segment: %w", err)
+	}
+	l.active = file
+	return nil
+}
+
+// index adds a record to the in-memory index. Callers hold l.mu or own l.
+func (l *Log) index(record Record) {
+	if l.ids[record.CorrelationId] {
+		return
+	}
+	l.ids[record.CorrelationId] = true
+
+	// Payments are settled roughly in requestedAt order, so this is almost always an append
+	i := sort.Search(len(l.records), func(i int) bool {
+		return l.records[i].RequestedAt > record.RequestedAt
+	})
+	l.records = append(l.records, Record{})
+	copy(l.records[i+1:], l.records[i:])
+	l.records[i] = record
+
+	totals := l.totals[record.Processor]
+	totals.Count++
+	totals.AmountCents += record.AmountCents
+	l.totals[record.Processor] = totals
+}
+
+// Append durably writes a record. It returns false, without writing, when the correlationId is already in the log.
+func (l *Log) Append(record Record) (bool, error) {
+	if len(record.Processor) > maxProcessorLength {
+		return false, fmt.Errorf("processor name too long: %d bytes", len(record.Processor))
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.ids[record.CorrelationId] {
+		return false, nil
+	}
+
+	frame := encodeFrame(record)
+	if _, err := l.active.Write(frame); err != nil {
+		return false, fmt.Errorf("failed to append record: %w", err)
+	}
+	if err := l.active.Sync(); err != nil {
+		return false, fmt.Errorf("failed to sync segment: %w", err)
+	}
+	l.activeSize += int64(len(frame))
+	l.index(record)
+
+	if l.activeSize >= l.segmentSize {
+		if err := l.roll(); err != nil {
+			return true, err
+		}
+	}
+
+	return true, nil
+}
+
+// roll seals the active segment and starts the next one. Callers hold l.mu.
+func (l *Log) roll() error {
+	if err := l.active.Close(); err != nil {
+		return fmt.Errorf("failed to seal segment: %w", err)
+	}
+	l.activeID++
+	l.activeSize = 0
+	l.sealedSinceSnapshot++
+	return l.openActive()
+}
+
+func (l *Log) Contains(correlationId uuid.UUID) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return l.ids[correlationId]
+}
+
+// Range returns the records requested between from and to, both inclusive, in unix nanoseconds.
+func (l *Log) Range(from, to int64) []Record {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	start, end := l.bounds(from, to)
+	return append([]Record(nil), l.records[start:end]...)
+}
+
+// RangePage returns at most limit of the records Range would, past the first skip of them.
+func (l *Log) RangePage(from, to int64, skip, limit int) []Record {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	start, end := l.bounds(from, to)
+	start = min(start+skip, end)
+	end = min(end, start+limit)
+	return append([]Record(nil), l.records[start:end]...)
+}
+
+// RangeTotals sums the records requested between from and to per processor.
+func (l *Log) RangeTotals(from, to int64) map[string]Totals {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	start, end := l.bounds(from, to)
+	totals := make(map[string]Totals)
+	for _, record := range l.records[start:end] {
+		t := totals[record.Processor]
+		t.Count++
+		t.AmountCents += record.AmountCents
+		totals[record.Processor] = t
+	}
+	return totals
+}
+
+func (l *Log) bounds(from, to int64) (int, int) {
+	start := sort.Search(len(l.records), func(i int) bool {
+		return l.records[i].RequestedAt >= from
+	})
+	end := sort.Search(len(l.records), func(i int) bool {
+		return l.records[i].RequestedAt > to
+	})
+	if start > end {
+		start = end
+	}
+	return start, end
+}
+
+func (l *Log) All() []Record {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return append([]Record(nil), l.records...)
+}
+
+func (l *Log) Totals() map[string]Totals {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	totals := make(map[string]Totals, len(l.totals))
+	for processor, t := range l.totals {
+		totals[processor] = t
+	}
+	return totals
+}
+
+// SealedSegments returns how many segments were sealed since the last snapshot.
+func (l *Log) SealedSegments() int {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return l.sealedSinceSnapshot
+}
+
+// Snapshot writes every record to a snapshot and compacts away the segments and snapshots it replaces.
+// Appends only wait while the active segment is rolled over, not while the snapshot is written.
+func (l *Log) Snapshot() error {
+	l.snapshotMu.Lock()
+	defer l.snapshotMu.Unlock()
+
+	l.mu.Lock()
+	if err := l.roll(); err != nil {
+		l.mu.Unlock()
+		return err
+	}
+	snapshotID := l.activeID
+	records := append([]Record(nil), l.records...)
+	sealed := l.sealedSinceSnapshot
+	l.mu.Unlock()
+
+	if err := writeSnapshot(snapshotPath(l.dir, snapshotID), records); err != nil {
+		return err
+	}
+	if err := l.compact(snapshotID); err != nil {
+		return err
+	}
+
+	// Segments sealed while the snapshot was written are left for the next one
+	l.mu.Lock()
+	l.sealedSinceSnapshot -= sealed
+	l.mu.Unlock()
+	return nil
+}
+
+// compact deletes the segments and snapshots older than the snapshot with the given id,
+// which must already be durable and verified.
+func (l *Log) compact(snapshotID uint64) error {
+	segments, err := listFiles(l.dir, segmentExtension)
+	if err != nil {
+		return fmt.Errorf("failed to list segments: %w", err)
+	}
+	for _, id := range segments {
+		if id < snapshotID {
+			if err := os.Remove(segmentPath(l.dir, id)); err != nil {
+				return fmt.Errorf("failed to delete segment: %w", err)
+			}
+		}
+	}
+
+	snapshots, err := listFiles(l.dir, snapshotExtension)
+	if err != nil {
+		return fmt.Errorf("failed to list snapshots: %w", err)
+	}
+	for _, id := range snapshots {
+		if id < snapshotID {
+			if err := os.Remove(snapshotPath(l.dir, id)); err != nil {
+				return fmt.Errorf("failed to delete snapshot: %w", err)
+			}
+		}
+	}
+
+	return syncDir(l.dir)
+}
+
+// Purge deletes every record, segment and snapshot.
+func (l *Log) Purge() error {
+	l.snapshotMu.Lock()
+	defer l.snapshotMu.Unlock()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// An empty snapshot past the active segment makes recovery ignore everything before it,
+	// so a crash halfway through deleting the files can't bring records back
+	nextID := l.activeID + 1
+	if err := writeSnapshot(snapshotPath(l.dir, nextID), nil); err != nil {
+		return err
+	}
+
+	l.active.Close()
+	l.reset()
+	l.activeID = nextID
+	l.activeSize = 0
+	if err := l.openActive(); err != nil {
+		return err
+	}
+
+	return l.compact(nextID)
+}
+
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.active.Close()
+}
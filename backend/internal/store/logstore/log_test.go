@@ -0,0 +1,118 @@
+package logstore
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func appendRecords(t *testing.T, l *Log, n int) {
+	t.Helper()
+	for i := range n {
+		record := Record{CorrelationId: uuid.New(), AmountCents: 100, Processor: "default", RequestedAt: int64(i)}
+		if _, err := l.Append(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSnapshotRecovery(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(Options{Dir: dir, SegmentSize: 256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendRecords(t, l, 20)
+	if err := l.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	appendRecords(t, l, 5)
+	l.Close()
+
+	snapshots, _ := listFiles(dir, snapshotExtension)
+	if len(snapshots) != 1 {
+		t.Fatalf("snapshots = %v, want only the newest", snapshots)
+	}
+
+	l, err = Open(Options{Dir: dir, SegmentSize: 256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if got := l.Totals()["default"].Count; got != 25 {
+		t.Fatalf("recovered %d records, want 25", got)
+	}
+}
+
+func TestOpenFailsOnCorruptSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(Options{Dir: dir, SegmentSize: 256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendRecords(t, l, 20)
+	if err := l.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+
+	snapshots, _ := listFiles(dir, snapshotExtension)
+	path := snapshotPath(dir, snapshots[len(snapshots)-1])
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)/2] ^= 0xff
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if l, err := Open(Options{Dir: dir, SegmentSize: 256}); err == nil {
+		l.Close()
+		t.Fatal("Open succeeded with a corrupt snapshot")
+	}
+}
+
+func TestFailedSnapshotIsRetried(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(Options{Dir: dir, SegmentSize: 256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	appendRecords(t, l, 20)
+	sealed := l.SealedSegments()
+	if sealed == 0 {
+		t.Fatal("no segment was sealed")
+	}
+
+	// A directory in the way of the snapshot file makes writing it fail
+	blocked := snapshotPath(dir, l.activeID+1) + ".tmp"
+	if err := os.Mkdir(blocked, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Snapshot(); err == nil {
+		t.Fatal("Snapshot succeeded with its file blocked")
+	}
+	if got := l.SealedSegments(); got <= sealed {
+		t.Fatalf("SealedSegments after a failed snapshot = %d, want more than %d so the next tick retries", got, sealed)
+	}
+
+	if err := os.Remove(blocked); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	if got := l.SealedSegments(); got != 0 {
+		t.Fatalf("SealedSegments after a snapshot = %d, want 0", got)
+	}
+	if snapshots, _ := listFiles(dir, snapshotExtension); len(snapshots) != 1 {
+		t.Fatalf("snapshots = %v, want one", snapshots)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(dir, "*.tmp")); len(matches) != 0 {
+		t.Fatalf("left %v behind", matches)
+	}
+}
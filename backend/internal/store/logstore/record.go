@@ -0,0 +1,99 @@
+package logstore
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+
+	"github.com/google/uuid"
+)
+
+// Record is a settled payment as kept in the log.
+type Record struct {
+	CorrelationId uuid.UUID
+	AmountCents   int64
+	Processor     string
+	RequestedAt   int64 // unix nanoseconds
+}
+
+// Each record is framed as length, CRC-32 of the payload, then the payload:
+// correlationId (16 bytes), amount, requestedAt, processor length (1 byte) and processor.
+const (
+	frameHeaderSize    = 8
+	recordFixedSize    = 16 + 8 + 8 + 1
+	maxProcessorLength = 255
+)
+
+var (
+	errTornFrame    = errors.New("torn record frame")
+	errCorruptFrame = errors.New("corrupt record frame")
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+func (r Record) size() int {
+	return recordFixedSize + len(r.Processor)
+}
+
+func (r Record) appendTo(buf []byte) []byte {
+	buf = append(buf, r.CorrelationId[:]...)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(r.AmountCents))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(r.RequestedAt))
+	buf = append(buf, byte(len(r.Processor)))
+	return append(buf, r.Processor...)
+}
+
+func decodeRecord(payload []byte) (Record, int, error) {
+	if len(payload) < recordFixedSize {
+		return Record{}, 0, errCorruptFrame
+	}
+
+	var r Record
+	copy(r.CorrelationId[:], payload[:16])
+	r.AmountCents = int64(binary.BigEndian.Uint64(payload[16:24]))
+	r.RequestedAt = int64(binary.BigEndian.Uint64(payload[24:32]))
+
+	processorLength := int(payload[32])
+	if len(payload) < recordFixedSize+processorLength {
+		return Record{}, 0, errCorruptFrame
+	}
+	r.Processor = string(payload[recordFixedSize : recordFixedSize+processorLength])
+
+	return r, recordFixedSize + processorLength, nil
+}
+
+func encodeFrame(r Record) []byte {
+	frame := make([]byte, frameHeaderSize, frameHeaderSize+r.size())
+	frame = r.appendTo(frame)
+	binary.BigEndian.PutUint32(frame[0:4], uint32(len(frame)-frameHeaderSize))
+	binary.BigEndian.PutUint32(frame[4:8], crc32.Checksum(frame[frameHeaderSize:], crcTable))
+	return frame
+}
+
+// decodeFrame reads the frame at the start of data and returns it with its length.
+// errTornFrame means data ends in the middle of the frame.
+func decodeFrame(data []byte) (Record, int, error) {
+	if len(data) < frameHeaderSize {
+		return Record{}, 0, errTornFrame
+	}
+
+	length := int(binary.BigEndian.Uint32(data[0:4]))
+	if length < recordFixedSize || length > recordFixedSize+maxProcessorLength {
+		return Record{}, 0, errCorruptFrame
+	}
+	if len(data) < frameHeaderSize+length {
+		return Record{}, 0, errTornFrame
+	}
+
+	payload := data[frameHeaderSize : frameHeaderSize+length]
+	if crc32.Checksum(payload, crcTable) != binary.BigEndian.Uint32(data[4:8]) {
+		return Record{}, 0, errCorruptFrame
+	}
+
+	r, n, err := decodeRecord(payload)
+	if err != nil || n != length {
+		return Record{}, 0, errCorruptFrame
+	}
+
+	return r, frameHeaderSize + length, nil
+}
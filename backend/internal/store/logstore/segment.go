@@ -0,0 +1,90 @@
+package logstore
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	segmentExtension  = ".seg"
+	snapshotExtension = ".snap"
+)
+
+func segmentPath(dir string, id uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d%s", id, segmentExtension))
+}
+
+func snapshotPath(dir string, id uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d%s", id, snapshotExtension))
+}
+
+// listFiles returns the ids of the files in dir with the given extension, in ascending order.
+func listFiles(dir, extension string) ([]uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []uint64
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, extension) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, extension), 10, 64)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+// replaySegment calls apply for every record in the segment.
+// When repairTail is set a torn or corrupt frame at the end, left by a crash mid-write,
+// is truncated away; anywhere else it is an error.
+func replaySegment(path string, repairTail bool, apply func(Record)) (int64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read segment %s: %w", filepath.Base(path), err)
+	}
+
+	offset := 0
+	for offset < len(data) {
+		record, n, err := decodeFrame(data[offset:])
+		if err != nil {
+			if !repairTail || !isTail(data[offset:], err) {
+				return 0, fmt.Errorf("segment %s at offset %d: %w", filepath.Base(path), offset, err)
+			}
+			if err := os.Truncate(path, int64(offset)); err != nil {
+				return 0, fmt.Errorf("failed to repair segment %s: %w", filepath.Base(path), err)
+			}
+			break
+		}
+		apply(record)
+		offset += n
+	}
+
+	return int64(offset), nil
+}
+
+// isTail tells whether a bad frame can be the last, partially written one. A crash leaves at most
+// one incomplete write, so a corrupt frame with valid data after it means real corruption.
+func isTail(data []byte, err error) bool {
+	if errors.Is(err, errTornFrame) {
+		return true
+	}
+	if len(data) < frameHeaderSize {
+		return true
+	}
+	length := int(binary.BigEndian.Uint32(data[0:4]))
+	return frameHeaderSize+length >= len(data)
+}
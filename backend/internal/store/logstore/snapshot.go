@@ -0,0 +1,129 @@
+package logstore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// A snapshot holds every record from the segments before its id, so those segments can be dropped.
+// Layout: magic, version, record count, the records (without frames) and a CRC-32 of all of it.
+var snapshotMagic = []byte("PLSN")
+
+const snapshotVersion = 1
+
+var errCorruptSnapshot = errors.New("corrupt snapshot")
+
+// writeSnapshot installs the snapshot durably: the file is synced before the rename, the directory
+// after it, and the installed file is read back before the caller may drop what it replaces.
+func writeSnapshot(path string, records []Record) error {
+	tmpPath := path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot: %w", err)
+	}
+	defer os.Remove(tmpPath) // no-op once renamed
+
+	crc := crc32.New(crcTable)
+	writer := bufio.NewWriter(io.MultiWriter(file, crc))
+
+	header := append([]byte(nil), snapshotMagic...)
+	header = binary.BigEndian.AppendUint32(header, snapshotVersion)
+	header = binary.BigEndian.AppendUint64(header, uint64(len(records)))
+	writer.Write(header)
+
+	buf := make([]byte, 0, recordFixedSize+maxProcessorLength)
+	for _, record := range records {
+		buf = record.appendTo(buf[:0])
+		writer.Write(buf)
+	}
+
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	if err := binary.Write(file, binary.BigEndian, crc.Sum32()); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to sync snapshot: %w", err)
+	}
+	file.Close()
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to install snapshot: %w", err)
+	}
+	if err := syncDir(filepath.Dir(path)); err != nil {
+		return fmt.Errorf("failed to sync snapshot directory: %w", err)
+	}
+
+	// A snapshot that doesn't read back is removed, the previous one and its segments are still there
+	written, err := readSnapshot(path)
+	if err == nil && len(written) != len(records) {
+		err = fmt.Errorf("%d records, want %d", len(written), len(records))
+	}
+	if err != nil {
+		os.Remove(path)
+		syncDir(filepath.Dir(path))
+		return fmt.Errorf("failed to verify snapshot: %w", err)
+	}
+
+	return nil
+}
+
+// syncDir makes renames and deletions in dir durable.
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
+
+func readSnapshot(path string) ([]Record, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshot: %w", err)
+	}
+
+	headerSize := len(snapshotMagic) + 4 + 8
+	if len(data) < headerSize+4 || !bytes.Equal(data[:len(snapshotMagic)], snapshotMagic) {
+		return nil, errCorruptSnapshot
+	}
+
+	body, checksum := data[:len(data)-4], binary.BigEndian.Uint32(data[len(data)-4:])
+	if crc32.Checksum(body, crcTable) != checksum {
+		return nil, errCorruptSnapshot
+	}
+
+	version := binary.BigEndian.Uint32(data[len(snapshotMagic):])
+	if version != snapshotVersion {
+		return nil, fmt.Errorf("unsupported snapshot version %d", version)
+	}
+
+	count := binary.BigEndian.Uint64(data[len(snapshotMagic)+4:])
+	records := make([]Record, 0, min(count, uint64(len(body)/recordFixedSize)))
+	offset := headerSize
+	for range count {
+		record, n, err := decodeRecord(body[offset:])
+		if err != nil {
+			return nil, errCorruptSnapshot
+		}
+		records = append(records, record)
+		offset += n
+	}
+	if offset != len(body) {
+		return nil, errCorruptSnapshot
+	}
+
+	return records, nil
+}
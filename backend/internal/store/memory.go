@@ -0,0 +1,260 @@
+package store
+
+import (
+	"context"
+	"rinha-backend-arthur/internal/models"
+	"rinha-backend-arthur/internal/queue"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// MemoryStore keeps everything in process memory, for tests and single instance runs.
+// It can't apply queue acks, SettlePayment always leaves them to the caller.
+type MemoryStore struct {
+	mu               sync.Mutex
+	accepted         map[uuid.UUID]bool
+	settled          map[uuid.UUID]bool
+	payments         []models.Payment // ordered by RequestedAt
+	summaries        map[string]models.Summary
+	transitions      map[uuid.UUID][]models.PaymentTransition
+	processorErrors  map[string]int64
+	locks            map[string]memoryLock
+	healthyProcessor string
+}
+
+func NewMemoryStore() *MemoryStore {
+	s := &MemoryStore{}
+	s.reset()
+	return s
+}
+
+func (s *MemoryStore) reset() {
+	s.accepted = make(map[uuid.UUID]bool)
+	s.settled = make(map[uuid.UUID]bool)
+	s.payments = nil
+	s.summaries = make(map[string]models.Summary)
+	s.transitions = make(map[uuid.UUID][]models.PaymentTransition)
+	s.processorErrors = make(map[string]int64)
+	s.locks = make(map[string]memoryLock)
+	s.healthyProcessor = ""
+}
+
+func (s *MemoryStore) AcceptPayment(ctx context.Context, msg models.QueueMessage) (bool, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.accepted[msg.CorrelationId] {
+		return false, false, nil
+	}
+	s.accepted[msg.CorrelationId] = true
+	return true, false, nil
+}
+
+func (s *MemoryStore) UnmarkPaymentAccepted(ctx context.Context, correlationId uuid.UUID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.accepted, correlationId)
+	return nil
+}
+
+func (s *MemoryStore) DiscardPayment(ctx context.Context, correlationId uuid.UUID) (bool, error) {
+	return false, s.UnmarkPaymentAccepted(ctx, correlationId)
+}
+
+func (s *MemoryStore) IsPaymentSettled(ctx context.Context, correlationId uuid.UUID) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.settled[correlationId], nil
+}
+
+func (s *MemoryStore) StorePayment(ctx context.Context, payment models.Payment) error {
+	_, err := s.SettlePayment(ctx, payment, queue.Delivery{})
+	return err
+}
+
+func (s *MemoryStore) SettlePayment(ctx context.Context, payment models.Payment, delivery queue.Delivery) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.settled[payment.CorrelationId] {
+		return false, ErrPaymentAlreadyStored
+	}
+	s.settled[payment.CorrelationId] = true
+
+	i := sort.Search(len(s.payments), func(i int) bool {
+		return s.payments[i].RequestedAt.After(payment.RequestedAt)
+	})
+	s.payments = append(s.payments, models.Payment{})
+	copy(s.payments[i+1:], s.payments[i:])
+	s.payments[i] = payment
+
+	summary := s.summaries[payment.Service]
+	summary.TotalRequests++
+	summary.TotalAmount += payment.Amount
+	s.summaries[payment.Service] = summary
+
+	return false, nil
+}
+
+func (s *MemoryStore) GetPaymentSummaryDirect(ctx context.Context) (models.PaymentSummaryResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	defaultSummary := s.summaries["default"]
+	fallbackSummary := s.summaries["fallback"]
+
+	return models.PaymentSummaryResponse{
+		Default: models.SummaryResponse{
+			TotalRequests: defaultSummary.TotalRequests,
+			TotalAmount:   defaultSummary.TotalAmount,
+		},
+		Fallback: models.SummaryResponse{
+			TotalRequests: fallbackSummary.TotalRequests,
+			TotalAmount:   fallbackSummary.TotalAmount,
+		},
+	}, nil
+}
+
+func (s *MemoryStore) GetPaymentSummaryByTime(ctx context.Context, from, to time.Time) (models.PaymentSummaryResponse, error) {
+	payments, err := s.GetPaymentsByTime(ctx, from, to)
+	if err != nil {
+		return models.PaymentSummaryResponse{}, err
+	}
+	return summarizePayments(payments), nil
+}
+
+func (s *MemoryStore) GetPaymentsByTime(ctx context.Context, from, to time.Time) ([]models.Payment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	start := sort.Search(len(s.payments), func(i int) bool {
+		return !s.payments[i].RequestedAt.Before(from)
+	})
+	end := sort.Search(len(s.payments), func(i int) bool {
+		return s.payments[i].RequestedAt.After(to)
+	})
+	if start >= end {
+		return nil, nil
+	}
+
+	return append([]models.Payment(nil), s.payments[start:end]...), nil
+}
+
+// StreamPayments copies one page at a time under the lock, so settling isn't held up by yield.
+func (s *MemoryStore) StreamPayments(ctx context.Context, from, to time.Time, yield func(models.Payment) error) error {
+	from, to = openRange(from, to)
+	return streamPages(ctx, from, yield, func(from time.Time, skip int) []models.Payment {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		start := sort.Search(len(s.payments), func(i int) bool {
+			return !s.payments[i].RequestedAt.Before(from)
+		})
+		end := sort.Search(len(s.payments), func(i int) bool {
+			return s.payments[i].RequestedAt.After(to)
+		})
+		start = min(start+skip, end)
+		end = min(end, start+streamChunkSize)
+
+		return append([]models.Payment(nil), s.payments[start:end]...)
+	})
+}
+
+func (s *MemoryStore) RecordPaymentTransition(ctx context.Context, correlationId uuid.UUID, transition models.PaymentTransition) error {
+	if transition.At.IsZero() {
+		transition.At = time.Now().UTC()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.transitions[correlationId] = append(s.transitions[correlationId], transition)
+	return nil
+}
+
+func (s *MemoryStore) GetPaymentStatus(ctx context.Context, correlationId uuid.UUID) (*models.PaymentStatusResponse, error) {
+	s.mu.Lock()
+	transitions := append([]models.PaymentTransition(nil), s.transitions[correlationId]...)
+	s.mu.Unlock()
+
+	if len(transitions) == 0 {
+		return nil, nil
+	}
+
+	return buildPaymentStatus(correlationId, transitions), nil
+}
+
+func (s *MemoryStore) IncrementProcessorErrors(ctx context.Context, class string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.processorErrors[class]++
+	return nil
+}
+
+func (s *MemoryStore) GetProcessorErrors(ctx context.Context) (map[string]int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := make(map[string]int64, len(s.processorErrors))
+	for class, count := range s.processorErrors {
+		result[class] = count
+	}
+	return result, nil
+}
+
+type memoryLock struct {
+	token     string
+	expiresAt time.Time
+}
+
+func (s *MemoryStore) AcquireLock(ctx context.Context, name string, ttl time.Duration) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if lock, ok := s.locks[name]; ok && now.Before(lock.expiresAt) {
+		return "", nil
+	}
+	token := uuid.NewString()
+	s.locks[name] = memoryLock{token: token, expiresAt: now.Add(ttl)}
+	return token, nil
+}
+
+func (s *MemoryStore) ReleaseLock(ctx context.Context, name string, token string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.locks[name].token == token {
+		delete(s.locks, name)
+	}
+	return nil
+}
+
+func (s *MemoryStore) SetHealthyProcessor(ctx context.Context, service string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.healthyProcessor = service
+	return nil
+}
+
+func (s *MemoryStore) GetHealthyProcessor(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.healthyProcessor, nil
+}
+
+func (s *MemoryStore) PurgeAllData(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.reset()
+	return nil
+}
@@ -0,0 +1,26 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+)
+
+// IncrementProcessorErrors counts a failed processor request by error class, shared by all replicas.
+func (s *RedisStore) IncrementProcessorErrors(ctx context.Context, class string) error {
+	return s.client.HIncrBy(ctx, s.keys.processorErrors, class, 1).Err()
+}
+
+func (s *RedisStore) GetProcessorErrors(ctx context.Context) (map[string]int64, error) {
+	counts, err := s.client.HGetAll(ctx, s.keys.processorErrors).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve processor error counts: %w", err)
+	}
+
+	result := make(map[string]int64, len(counts))
+	for class, count := range counts {
+		result[class], _ = strconv.ParseInt(count, 10, 64)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,301 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"rinha-backend-arthur/internal/keyspace"
+	"rinha-backend-arthur/internal/models"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+// RecordMigrator is implemented by stores whose records can be rewritten in the current version.
+type RecordMigrator interface {
+	// MigrateRecords rewrites older records in batches of batchSize. The store keeps serving
+	// reads and writes meanwhile, and running it again only picks up what is left.
+	MigrateRecords(ctx context.Context, batchSize int) (MigrationResult, error)
+}
+
+// SummaryBackfiller is implemented by stores keeping pre-aggregated summaries that payments
+// stored before the aggregates existed are missing from.
+type SummaryBackfiller interface {
+	// BackfillSummaries rebuilds the aggregates from the stored payments and returns how many it wrote.
+	BackfillSummaries(ctx context.Context) (int, error)
+}
+
+// LegacyKeyAdopter is implemented by stores that wrote keys without the deployment prefix before.
+type LegacyKeyAdopter interface {
+	// AdoptLegacyKeys moves the unprefixed keys into the keyspace and returns how many it moved.
+	// A key whose new name is taken already is left in place and reported in the error.
+	AdoptLegacyKeys(ctx context.Context) (int, error)
+}
+
+type MigrationResult struct {
+	Scanned  int // records looked at
+	Migrated int // records rewritten in the current version
+	Skipped  int // records that can't be decoded or encoded, left untouched
+}
+
+// migrateMembersScript swaps old payments set members for their new encoding, keeping the score.
+// A member removed since it was scanned, by a purge for instance, is not brought back.
+//
+// KEYS: payments set
+// ARGV: old member, new member, and so on
+var migrateMembersScript = redis.NewScript(`
+local migrated = 0
+for i = 1, #ARGV, 2 do
+	local score = redis.call('ZSCORE', KEYS[1], ARGV[i])
+	if score then
+		redis.call('ZREM', KEYS[1], ARGV[i])
+		redis.call('ZADD', KEYS[1], score, ARGV[i + 1])
+		migrated = migrated + 1
+	end
+end
+return migrated
+`)
+
+// moveLegacyPaymentsLua defines moveLegacyPayments, which moves a legacy payments hash out of the
+// payments key into the legacy hash, so the key can take the payments set. Replicas still on the
+// old version may write a new hash meanwhile, it is merged into the legacy one.
+const moveLegacyPaymentsLua = `
+local function moveLegacyPayments(payments, legacy)
+	if redis.call('TYPE', payments).ok ~= 'hash' then
+		return
+	end
+	if redis.call('EXISTS', legacy) == 0 then
+		redis.call('RENAME', payments, legacy)
+		return
+	end
+	local entries = redis.call('HGETALL', payments)
+	for i = 1, #entries, 2 do
+		redis.call('HSET', legacy, entries[i], entries[i + 1])
+	end
+	redis.call('DEL', payments)
+end
+`
+
+// KEYS: payments key, legacy hash
+var moveLegacyPaymentsScript = redis.NewScript(moveLegacyPaymentsLua + `
+moveLegacyPayments(KEYS[1], KEYS[2])
+return redis.call('EXISTS', KEYS[2])
+`)
+
+// legacyKeys maps the keys written before keys had a prefix to their current names.
+func (s *RedisStore) legacyKeys() map[string]string {
+	return map[string]string{
+		"payments":                          s.keys.payments,
+		"payments:stats:default":            s.keys.stats("default"),
+		"payments:stats:fallback":           s.keys.stats("fallback"),
+		"payments:metrics:processor_errors": s.keys.processorErrors,
+		"healthy_processor_status":          s.keys.healthyProcessor,
+	}
+}
+
+// AdoptLegacyKeys renames the store's unprefixed keys and turns the legacy accepted and settled
+// sets into one key per correlationId. Old replicas must be stopped first, they would write the
+// legacy keys again. Summary buckets aren't moved, BackfillSummaries rebuilds them.
+func (s *RedisStore) AdoptLegacyKeys(ctx context.Context) (int, error) {
+	adopted, conflicts := keyspace.AdoptAll(ctx, s.client, s.legacyKeys())
+	if conflicts != nil && !errors.Is(conflicts, keyspace.ErrKeyExists) {
+		return adopted, conflicts
+	}
+
+	statuses, err := keyspace.AdoptMatching(ctx, s.client, "payments:status:*", func(legacy string) string {
+		return s.keys.space.Key(legacy)
+	})
+	adopted += statuses
+	if err != nil && !errors.Is(err, keyspace.ErrKeyExists) {
+		return adopted, err
+	}
+	conflicts = errors.Join(conflicts, err)
+
+	for legacy, key := range map[string]func(uuid.UUID) string{
+		"payments:accepted": s.keys.accepted,
+		"payments:settled":  s.keys.settled,
+	} {
+		split, err := s.splitLegacySet(ctx, legacy, key)
+		if err != nil {
+			return adopted, err
+		}
+		if split {
+			adopted++
+		}
+	}
+	return adopted, conflicts
+}
+
+// splitLegacySet writes a key expiring after the idempotency TTL for every correlationId of a
+// legacy set, then deletes the set. Keys written since by the current version are kept.
+// It returns false when there is no legacy set.
+func (s *RedisStore) splitLegacySet(ctx context.Context, legacy string, key func(uuid.UUID) string) (bool, error) {
+	var found bool
+	var cursor uint64
+	for {
+		members, next, err := s.client.SScan(ctx, legacy, cursor, "", 1000).Result()
+		if err != nil {
+			return false, fmt.Errorf("failed to scan %s: %w", legacy, err)
+		}
+		found = found || len(members) > 0
+
+		pipe := s.client.Pipeline()
+		for _, member := range members {
+			correlationId, err := uuid.Parse(member)
+			if err != nil {
+				continue // Drop malformed data
+			}
+			pipe.SetNX(ctx, key(correlationId), "1", s.idempotencyTTL)
+		}
+		if _, err := pipe.Exec(ctx); err != nil {
+			return false, fmt.Errorf("failed to split %s: %w", legacy, err)
+		}
+
+		cursor = next
+		if cursor == 0 {
+			break
+		}
+	}
+
+	if !found {
+		return false, nil
+	}
+	if err := s.client.Del(ctx, legacy).Err(); err != nil {
+		return false, fmt.Errorf("failed to delete %s: %w", legacy, err)
+	}
+	return true, nil
+}
+
+// MigrateRecords drains a legacy payments hash into the payments set, then rewrites the set
+// members still in an older version.
+func (s *RedisStore) MigrateRecords(ctx context.Context, batchSize int) (MigrationResult, error) {
+	legacy, err := moveLegacyPaymentsScript.Run(ctx, s.client, []string{s.keys.payments, s.keys.legacy}).Int()
+	if err != nil {
+		return MigrationResult{}, fmt.Errorf("failed to move legacy payments aside: %w", err)
+	}
+
+	var result MigrationResult
+	if legacy == 1 {
+		if result, err = s.migratePaymentsHash(ctx, batchSize); err != nil {
+			return result, err
+		}
+	}
+
+	setResult, err := s.migratePaymentsSet(ctx, batchSize)
+	result.Scanned += setResult.Scanned
+	result.Migrated += setResult.Migrated
+	result.Skipped += setResult.Skipped
+	return result, err
+}
+
+func (s *RedisStore) migratePaymentsSet(ctx context.Context, batchSize int) (MigrationResult, error) {
+	var result MigrationResult
+	var cursor uint64
+
+	for {
+		// ZSCAN returns member, score pairs
+		entries, next, err := s.client.ZScan(ctx, s.keys.payments, cursor, "", int64(batchSize)).Result()
+		if err != nil {
+			return result, fmt.Errorf("failed to scan payments: %w", err)
+		}
+
+		var args []any
+		for i := 0; i < len(entries); i += 2 {
+			result.Scanned++
+
+			record := []byte(entries[i])
+			if version, err := models.PaymentRecordVersion(record); err == nil && version == models.CurrentPaymentRecordVersion {
+				continue
+			}
+
+			migrated, err := reencodePaymentRecord(record)
+			if err != nil {
+				result.Skipped++
+				continue
+			}
+			args = append(args, entries[i], migrated)
+		}
+
+		if len(args) > 0 {
+			migrated, err := migrateMembersScript.Run(ctx, s.client, []string{s.keys.payments}, args...).Int()
+			if err != nil {
+				return result, fmt.Errorf("failed to migrate payments: %w", err)
+			}
+			result.Migrated += migrated
+		}
+
+		cursor = next
+		if cursor == 0 {
+			return result, nil
+		}
+	}
+}
+
+// migratePaymentsHash moves the legacy hash entries into the payments set, which takes writes
+// all along. Each batch is added and deleted from the hash in one transaction, and passes go on
+// until one migrates nothing, since old replicas may still merge new entries into the hash.
+// Entries that can't be decoded are left in the hash.
+func (s *RedisStore) migratePaymentsHash(ctx context.Context, batchSize int) (MigrationResult, error) {
+	var result MigrationResult
+
+	for {
+		var cursor uint64
+		var migrated, skipped int
+
+		for {
+			// HSCAN returns field, value pairs
+			entries, next, err := s.client.HScan(ctx, s.keys.legacy, cursor, "", int64(batchSize)).Result()
+			if err != nil {
+				return result, fmt.Errorf("failed to scan legacy payments: %w", err)
+			}
+
+			var members []redis.Z
+			var fields []string
+			for i := 1; i < len(entries); i += 2 {
+				payment, err := models.DecodePaymentRecord([]byte(entries[i]))
+				if err != nil {
+					skipped++
+					continue
+				}
+				record, err := models.EncodePaymentRecord(payment)
+				if err != nil {
+					skipped++
+					continue
+				}
+				members = append(members, redis.Z{Score: float64(payment.RequestedAt.UnixNano()), Member: record})
+				fields = append(fields, entries[i-1])
+			}
+
+			if len(members) > 0 {
+				pipe := s.client.TxPipeline()
+				pipe.ZAdd(ctx, s.keys.payments, members...)
+				pipe.HDel(ctx, s.keys.legacy, fields...)
+				if _, err := pipe.Exec(ctx); err != nil {
+					return result, fmt.Errorf("failed to migrate legacy payments: %w", err)
+				}
+				migrated += len(members)
+			}
+
+			cursor = next
+			if cursor == 0 {
+				break
+			}
+		}
+
+		// Skipped entries stay and are seen again by every pass, the last one counts them
+		result.Migrated += migrated
+		if migrated == 0 {
+			result.Skipped = skipped
+			result.Scanned = result.Migrated + skipped
+			return result, nil
+		}
+	}
+}
+
+func reencodePaymentRecord(record []byte) ([]byte, error) {
+	payment, err := models.DecodePaymentRecord(record)
+	if err != nil {
+		return nil, err
+	}
+	return models.EncodePaymentRecord(payment)
+}
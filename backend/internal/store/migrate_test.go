@@ -0,0 +1,151 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"rinha-backend-arthur/internal/keyspace"
+	"rinha-backend-arthur/internal/models"
+	"rinha-backend-arthur/internal/redistest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestMigrateLegacyPaymentsHash(t *testing.T) {
+	client, keys := redistest.Client(t)
+	ctx := context.Background()
+	s := NewRedisStore(client, RedisOptions{SummaryBucketSize: time.Second, Keys: keys, IdempotencyTTL: time.Hour})
+
+	base := time.Date(2025, 7, 1, 12, 0, 0, 0, time.UTC)
+	for i := range 20 {
+		id := uuid.NewString()
+		record := fmt.Sprintf(`{"correlationId":%q,"amount":%d,"paymentProcessor":"default","requestedAt":%q}`,
+			id, 100+i, base.Add(time.Duration(i)*time.Second).Format(time.RFC3339Nano))
+		client.HSet(ctx, s.keys.payments, id, record)
+	}
+	client.HSet(ctx, s.keys.payments, "broken", "{")
+
+	// The migration starts moving the hash aside, and a replica still on the old version
+	// writes a new hash before anything is settled
+	if err := moveLegacyPaymentsScript.Run(ctx, client, []string{s.keys.payments, s.keys.legacy}).Err(); err != nil {
+		t.Fatal(err)
+	}
+	id := uuid.NewString()
+	client.HSet(ctx, s.keys.payments, id, fmt.Sprintf(`{"correlationId":%q,"amount":1,"paymentProcessor":"default","requestedAt":%q}`,
+		id, base.Format(time.RFC3339Nano)))
+
+	// Settling still works, the new hash is merged into the legacy one
+	payment := models.Payment{
+		PaymentRequest: models.PaymentRequest{CorrelationId: uuid.New(), Amount: 5000, RequestedAt: base.Add(time.Hour)},
+		Service:        "fallback",
+	}
+	if err := s.StorePayment(ctx, payment); err != nil {
+		t.Fatalf("StorePayment with a legacy hash = %v", err)
+	}
+	if n := client.HLen(ctx, s.keys.legacy).Val(); n != 22 {
+		t.Fatalf("legacy hash has %d entries, want 22", n)
+	}
+
+	result, err := s.MigrateRecords(ctx, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Migrated != 21 || result.Skipped != 1 {
+		t.Fatalf("MigrateRecords = %+v, want 21 migrated and 1 skipped", result)
+	}
+	if n := client.HLen(ctx, s.keys.legacy).Val(); n != 1 {
+		t.Fatalf("legacy hash has %d entries left, want the broken one", n)
+	}
+
+	payments, err := s.GetPaymentsByTime(ctx, time.Time{}, base.Add(2*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	summary := summarizePayments(payments)
+	want := models.PaymentSummaryResponse{
+		Default:  models.SummaryResponse{TotalRequests: 21, TotalAmount: 20*100 + 190 + 1},
+		Fallback: models.SummaryResponse{TotalRequests: 1, TotalAmount: 5000},
+	}
+	if summary != want {
+		t.Fatalf("summary after migration = %+v, want %+v", summary, want)
+	}
+
+	// Running it again finds nothing left to do
+	if result, err := s.MigrateRecords(ctx, 5); err != nil || result.Migrated != 0 {
+		t.Fatalf("second MigrateRecords = %+v, %v", result, err)
+	}
+}
+
+func TestAdoptLegacyKeys(t *testing.T) {
+	if os.Getenv("TEST_REDIS_URL") != "" {
+		t.Skip("legacy keys have no prefix, they would clash on a shared server")
+	}
+	client, keys := redistest.Client(t)
+	ctx := context.Background()
+	s := NewRedisStore(client, RedisOptions{SummaryBucketSize: time.Second, Keys: keys, IdempotencyTTL: time.Hour})
+
+	settled, accepted := uuid.New(), uuid.New()
+	requestedAt := time.Date(2025, 7, 1, 12, 0, 0, 0, time.UTC)
+	record, err := models.EncodePaymentRecord(models.Payment{
+		PaymentRequest: models.PaymentRequest{CorrelationId: settled, Amount: 1990, RequestedAt: requestedAt},
+		Service:        "default",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.ZAdd(ctx, "payments", redis.Z{Score: float64(requestedAt.UnixNano()), Member: record})
+	client.HSet(ctx, "payments:stats:default", "count", 1, "amount", 1990)
+	client.HSet(ctx, "payments:stats:fallback", "count", 7, "amount", 700)
+	client.HSet(ctx, "payments:metrics:processor_errors", "default", 3)
+	client.RPush(ctx, "payments:status:"+settled.String(), `{"status":"processed"}`)
+	client.SAdd(ctx, "payments:accepted", settled.String(), accepted.String(), "broken")
+	client.SAdd(ctx, "payments:settled", settled.String())
+
+	// A replica of the new version settled a fallback payment already
+	client.HSet(ctx, s.keys.stats("fallback"), "count", 1, "amount", 100)
+
+	adopted, err := s.AdoptLegacyKeys(ctx)
+	if !errors.Is(err, keyspace.ErrKeyExists) {
+		t.Fatalf("AdoptLegacyKeys error = %v, want the fallback stats reported", err)
+	}
+	if adopted != 6 {
+		t.Fatalf("AdoptLegacyKeys moved %d keys, want 6", adopted)
+	}
+	if n := client.Exists(ctx, "payments:stats:fallback").Val(); n != 1 {
+		t.Fatal("the legacy fallback stats were not left in place")
+	}
+
+	summary, err := s.GetPaymentSummaryDirect(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Default.TotalRequests != 1 || summary.Default.TotalAmount != 1990 || summary.Fallback.TotalRequests != 1 {
+		t.Fatalf("summary after adopting = %+v", summary)
+	}
+	payments, err := s.GetPaymentsByTime(ctx, requestedAt, requestedAt)
+	if err != nil || len(payments) != 1 || payments[0].CorrelationId != settled {
+		t.Fatalf("GetPaymentsByTime = %v, %v, want the legacy payment", payments, err)
+	}
+	if status, err := s.GetPaymentStatus(ctx, settled); err != nil || status == nil {
+		t.Fatalf("GetPaymentStatus = %v, %v, want the legacy status", status, err)
+	}
+	if ok, err := s.IsPaymentSettled(ctx, settled); err != nil || !ok {
+		t.Fatalf("IsPaymentSettled = %v, %v, want true", ok, err)
+	}
+	if ttl := client.PTTL(ctx, s.keys.accepted(accepted)).Val(); ttl <= 0 || ttl > time.Hour {
+		t.Fatalf("accepted key TTL = %v, want the idempotency TTL", ttl)
+	}
+	if n := client.Exists(ctx, "payments:accepted", "payments:settled").Val(); n != 0 {
+		t.Fatalf("%d legacy sets left, want them deleted", n)
+	}
+
+	// Running it again only reports what is still in place
+	adopted, err = s.AdoptLegacyKeys(ctx)
+	if adopted != 0 || !errors.Is(err, keyspace.ErrKeyExists) {
+		t.Fatalf("AdoptLegacyKeys again = %d, %v", adopted, err)
+	}
+}
@@ -0,0 +1,39 @@
+-- Same shape as the processor's table, but logged: a crash must not lose settled payments.
+-- requested_at is kept in nanoseconds so range summaries match the Redis store exactly.
+CREATE TABLE payments (
+    correlation_id UUID PRIMARY KEY,
+    amount_cents BIGINT NOT NULL,
+    processor TEXT NOT NULL,
+    requested_at_ns BIGINT NOT NULL
+);
+
+CREATE INDEX payments_requested_at ON payments (requested_at_ns);
+
+CREATE TABLE accepted_payments (
+    correlation_id UUID PRIMARY KEY
+);
+
+-- Lifecycle history, losing it on a crash only loses debugging information
+CREATE UNLOGGED TABLE payment_transitions (
+    id BIGSERIAL PRIMARY KEY,
+    correlation_id UUID NOT NULL,
+    transition JSONB NOT NULL
+);
+
+CREATE INDEX payment_transitions_correlation_id ON payment_transitions (correlation_id, id);
+
+CREATE UNLOGGED TABLE processor_errors (
+    class TEXT PRIMARY KEY,
+    count BIGINT NOT NULL
+);
+
+CREATE UNLOGGED TABLE locks (
+    name TEXT PRIMARY KEY,
+    expires_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE UNLOGGED TABLE healthy_processor (
+    id SMALLINT PRIMARY KEY CHECK (id = 1),
+    service TEXT NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL
+);
@@ -0,0 +1,2 @@
+-- A lock is released only by the holder whose token it carries
+ALTER TABLE locks ADD COLUMN token TEXT NOT NULL DEFAULT '';
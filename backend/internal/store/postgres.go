@@ -0,0 +1,449 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"rinha-backend-arthur/internal/models"
+	"rinha-backend-arthur/internal/queue"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// PostgresStore keeps payments in PostgreSQL. Settled payments from all workers are written
+// in batches, and summaries are computed by the database.
+// It can't apply queue acks, SettlePayment always leaves them to the caller.
+type PostgresStore struct {
+	pool       *pgxpool.Pool
+	writes     chan postgresWrite
+	batchSize  int
+	batchDelay time.Duration
+	done       chan struct{} // closed once the batch writer stopped and the pool is closed
+}
+
+type postgresWrite struct {
+	payment models.Payment
+	result  chan error
+}
+
+// NewPostgresStore connects to the database and applies the pending migrations within initCtx,
+// then starts the batch writer. When ctx is cancelled the writer flushes the pending payments
+// and closes the pool.
+func NewPostgresStore(ctx, initCtx context.Context, url string, batchSize int, batchDelay time.Duration) (*PostgresStore, error) {
+	pool, err := pgxpool.New(initCtx, url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to postgres: %w", err)
+	}
+
+	if err := migratePostgres(initCtx, pool); err != nil {
+		pool.Close()
+		return nil, err
+	}
+
+	s := &PostgresStore{
+		pool:       pool,
+		writes:     make(chan postgresWrite, batchSize),
+		batchSize:  batchSize,
+		batchDelay: batchDelay,
+		done:       make(chan struct{}),
+	}
+
+	go s.writeBatches(ctx)
+
+	return s, nil
+}
+
+// Done is closed once the pending payments were written and the pool is closed,
+// after the ctx given to NewPostgresStore was cancelled.
+func (s *PostgresStore) Done() <-chan struct{} {
+	return s.done
+}
+
+// AcceptPayment never enqueues, the queue lives outside Postgres.
+func (s *PostgresStore) AcceptPayment(ctx context.Context, msg models.QueueMessage) (bool, bool, error) {
+	tag, err := s.pool.Exec(ctx, "INSERT INTO accepted_payments (correlation_id) VALUES ($1) ON CONFLICT DO NOTHING", msg.CorrelationId.String())
+	if err != nil {
+		return false, false, fmt.Errorf("failed to mark payment as accepted: %w", err)
+	}
+	return tag.RowsAffected() == 1, false, nil
+}
+
+func (s *PostgresStore) UnmarkPaymentAccepted(ctx context.Context, correlationId uuid.UUID) error {
+	_, err := s.pool.Exec(ctx, "DELETE FROM accepted_payments WHERE correlation_id = $1", correlationId.String())
+	return err
+}
+
+// DiscardPayment only forgets the correlationId, the dead letters live outside Postgres.
+func (s *PostgresStore) DiscardPayment(ctx context.Context, correlationId uuid.UUID) (bool, error) {
+	return false, s.UnmarkPaymentAccepted(ctx, correlationId)
+}
+
+func (s *PostgresStore) IsPaymentSettled(ctx context.Context, correlationId uuid.UUID) (bool, error) {
+	var settled bool
+	err := s.pool.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM payments WHERE correlation_id = $1)", correlationId.String()).Scan(&settled)
+	return settled, err
+}
+
+func (s *PostgresStore) StorePayment(ctx context.Context, payment models.Payment) error {
+	_, err := s.SettlePayment(ctx, payment, queue.Delivery{})
+	return err
+}
+
+// SettlePayment hands the payment to the batch writer and waits until its batch is committed.
+// Once handed over, the outcome of the insert is reported even if ctx is cancelled meanwhile,
+// so a committed payment is never reported as failed.
+func (s *PostgresStore) SettlePayment(ctx context.Context, payment models.Payment, delivery queue.Delivery) (bool, error) {
+	write := postgresWrite{payment: payment, result: make(chan error, 1)}
+
+	select {
+	case s.writes <- write:
+	case <-s.done:
+		return false, ErrStoreClosed
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+
+	select {
+	case err := <-write.result:
+		return false, err
+	case <-s.done:
+		// The writer may have answered right before stopping
+		select {
+		case err := <-write.result:
+			return false, err
+		default:
+			return false, ErrStoreClosed
+		}
+	}
+}
+
+// writeBatches groups the payments settled by all workers into a single insert.
+// A batch is written when it is full or batchDelay after its first payment arrived.
+func (s *PostgresStore) writeBatches(ctx context.Context) {
+	defer close(s.done)
+	defer s.pool.Close()
+
+	for {
+		var first postgresWrite
+		select {
+		case first = <-s.writes:
+		case <-ctx.Done():
+			s.flush()
+			return
+		}
+
+		batch := []postgresWrite{first}
+		timer := time.NewTimer(s.batchDelay)
+
+	collect:
+		for len(batch) < s.batchSize {
+			select {
+			case write := <-s.writes:
+				batch = append(batch, write)
+			case <-timer.C:
+				break collect
+			case <-ctx.Done():
+				break collect
+			}
+		}
+		timer.Stop()
+
+		s.insertBatch(batch)
+	}
+}
+
+// flush writes what was handed over before shutdown.
+func (s *PostgresStore) flush() {
+	for {
+		var batch []postgresWrite
+	collect:
+		for len(batch) < s.batchSize {
+			select {
+			case write := <-s.writes:
+				batch = append(batch, write)
+			default:
+				break collect
+			}
+		}
+		if len(batch) == 0 {
+			return
+		}
+		s.insertBatch(batch)
+	}
+}
+
+func (s *PostgresStore) insertBatch(batch []postgresWrite) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// The same correlationId twice in a batch is stored once, the later ones are duplicates
+	first := make(map[uuid.UUID]int, len(batch))
+	ids := make([]string, 0, len(batch))
+	amounts := make([]int64, 0, len(batch))
+	processors := make([]string, 0, len(batch))
+	requestedAt := make([]int64, 0, len(batch))
+	for i, write := range batch {
+		if _, ok := first[write.payment.CorrelationId]; ok {
+			continue
+		}
+		first[write.payment.CorrelationId] = i
+		ids = append(ids, write.payment.CorrelationId.String())
+		amounts = append(amounts, write.payment.Amount.Cents())
+		processors = append(processors, write.payment.Service)
+		requestedAt = append(requestedAt, write.payment.RequestedAt.UnixNano())
+	}
+
+	rows, err := s.pool.Query(ctx, `
+		INSERT INTO payments (correlation_id, amount_cents, processor, requested_at_ns)
+		SELECT id::uuid, amount, processor, requested_at
+		FROM unnest($1::text[], $2::bigint[], $3::text[], $4::bigint[]) AS batch (id, amount, processor, requested_at)
+		ON CONFLICT (correlation_id) DO NOTHING
+		RETURNING correlation_id::text`,
+		ids, amounts, processors, requestedAt)
+	if err != nil {
+		failBatch(batch, fmt.Errorf("failed to store payments: %w", err))
+		return
+	}
+
+	inserted := make(map[uuid.UUID]bool, len(ids))
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			continue
+		}
+		if correlationId, err := uuid.Parse(id); err == nil {
+			inserted[correlationId] = true
+		}
+	}
+	if err := rows.Err(); err != nil {
+		failBatch(batch, fmt.Errorf("failed to store payments: %w", err))
+		return
+	}
+
+	for i, write := range batch {
+		correlationId := write.payment.CorrelationId
+		if inserted[correlationId] && first[correlationId] == i {
+			write.result <- nil
+		} else {
+			write.result <- ErrPaymentAlreadyStored
+		}
+	}
+}
+
+func failBatch(batch []postgresWrite, err error) {
+	for _, write := range batch {
+		write.result <- err
+	}
+}
+
+func (s *PostgresStore) GetPaymentSummaryDirect(ctx context.Context) (models.PaymentSummaryResponse, error) {
+	return s.querySummary(ctx, `
+		SELECT processor, count(*), coalesce(sum(amount_cents), 0)::bigint
+		FROM payments
+		GROUP BY processor`)
+}
+
+func (s *PostgresStore) GetPaymentSummaryByTime(ctx context.Context, from, to time.Time) (models.PaymentSummaryResponse, error) {
+	return s.querySummary(ctx, `
+		SELECT processor, count(*), coalesce(sum(amount_cents), 0)::bigint
+		FROM payments
+		WHERE requested_at_ns BETWEEN $1 AND $2
+		GROUP BY processor`,
+		from.UnixNano(), to.UnixNano())
+}
+
+func (s *PostgresStore) querySummary(ctx context.Context, sql string, args ...any) (models.PaymentSummaryResponse, error) {
+	rows, err := s.pool.Query(ctx, sql, args...)
+	if err != nil {
+		return models.PaymentSummaryResponse{}, fmt.Errorf("failed to retrieve payment stats: %w", err)
+	}
+	defer rows.Close()
+
+	var summary models.PaymentSummaryResponse
+	for rows.Next() {
+		var processor string
+		var count, amount int64
+		if err := rows.Scan(&processor, &count, &amount); err != nil {
+			return models.PaymentSummaryResponse{}, fmt.Errorf("failed to retrieve payment stats: %w", err)
+		}
+
+		switch processor {
+		case "default":
+			summary.Default = models.SummaryResponse{TotalRequests: count, TotalAmount: models.Money(amount)}
+		case "fallback":
+			summary.Fallback = models.SummaryResponse{TotalRequests: count, TotalAmount: models.Money(amount)}
+		}
+	}
+
+	return summary, rows.Err()
+}
+
+func (s *PostgresStore) GetPaymentsByTime(ctx context.Context, from, to time.Time) ([]models.Payment, error) {
+	var payments []models.Payment
+	err := s.StreamPayments(ctx, from, to, func(payment models.Payment) error {
+		payments = append(payments, payment)
+		return nil
+	})
+	return payments, err
+}
+
+// StreamPayments reads the rows as they arrive from the server, so memory stays flat whatever the range.
+func (s *PostgresStore) StreamPayments(ctx context.Context, from, to time.Time, yield func(models.Payment) error) error {
+	from, to = openRange(from, to)
+	rows, err := s.pool.Query(ctx, `
+		SELECT correlation_id::text, amount_cents, processor, requested_at_ns
+		FROM payments
+		WHERE requested_at_ns BETWEEN $1 AND $2
+		ORDER BY requested_at_ns`,
+		from.UnixNano(), to.UnixNano())
+	if err != nil {
+		return fmt.Errorf("failed to retrieve payments: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id, processor string
+		var amount, requestedAt int64
+		if err := rows.Scan(&id, &amount, &processor, &requestedAt); err != nil {
+			return fmt.Errorf("failed to retrieve payments: %w", err)
+		}
+
+		correlationId, err := uuid.Parse(id)
+		if err != nil {
+			continue // Skip invalid data
+		}
+
+		err = yield(models.Payment{
+			PaymentRequest: models.PaymentRequest{
+				CorrelationId: correlationId,
+				Amount:        models.Money(amount),
+				RequestedAt:   time.Unix(0, requestedAt).UTC(),
+			},
+			Service: processor,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+func (s *PostgresStore) RecordPaymentTransition(ctx context.Context, correlationId uuid.UUID, transition models.PaymentTransition) error {
+	if transition.At.IsZero() {
+		transition.At = time.Now().UTC()
+	}
+
+	transitionJSON, err := json.Marshal(transition)
+	if err != nil {
+		return fmt.Errorf("failed to marshal payment transition: %w", err)
+	}
+
+	_, err = s.pool.Exec(ctx, "INSERT INTO payment_transitions (correlation_id, transition) VALUES ($1, $2)", correlationId.String(), transitionJSON)
+	if err != nil {
+		return fmt.Errorf("failed to record payment transition: %w", err)
+	}
+
+	return nil
+}
+
+func (s *PostgresStore) GetPaymentStatus(ctx context.Context, correlationId uuid.UUID) (*models.PaymentStatusResponse, error) {
+	rows, err := s.pool.Query(ctx, "SELECT transition FROM payment_transitions WHERE correlation_id = $1 ORDER BY id", correlationId.String())
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve payment status: %w", err)
+	}
+	defer rows.Close()
+
+	var transitions []models.PaymentTransition
+	for rows.Next() {
+		var transitionJSON []byte
+		if err := rows.Scan(&transitionJSON); err != nil {
+			return nil, fmt.Errorf("failed to retrieve payment status: %w", err)
+		}
+
+		var transition models.PaymentTransition
+		if err := json.Unmarshal(transitionJSON, &transition); err != nil {
+			continue // Skip malformed data
+		}
+		transitions = append(transitions, transition)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to retrieve payment status: %w", err)
+	}
+
+	if len(transitions) == 0 {
+		return nil, nil
+	}
+
+	return buildPaymentStatus(correlationId, transitions), nil
+}
+
+func (s *PostgresStore) IncrementProcessorErrors(ctx context.Context, class string) error {
+	_, err := s.pool.Exec(ctx, `
+		INSERT INTO processor_errors (class, count) VALUES ($1, 1)
+		ON CONFLICT (class) DO UPDATE SET count = processor_errors.count + 1`, class)
+	return err
+}
+
+func (s *PostgresStore) GetProcessorErrors(ctx context.Context) (map[string]int64, error) {
+	rows, err := s.pool.Query(ctx, "SELECT class, count FROM processor_errors")
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve processor error counts: %w", err)
+	}
+	defer rows.Close()
+
+	result := make(map[string]int64)
+	for rows.Next() {
+		var class string
+		var count int64
+		if err := rows.Scan(&class, &count); err != nil {
+			return nil, fmt.Errorf("failed to retrieve processor error counts: %w", err)
+		}
+		result[class] = count
+	}
+
+	return result, rows.Err()
+}
+
+func (s *PostgresStore) AcquireLock(ctx context.Context, name string, ttl time.Duration) (string, error) {
+	token := uuid.NewString()
+	tag, err := s.pool.Exec(ctx, `
+		INSERT INTO locks (name, expires_at, token) VALUES ($1, now() + $2::float8 * interval '1 second', $3)
+		ON CONFLICT (name) DO UPDATE SET expires_at = EXCLUDED.expires_at, token = EXCLUDED.token
+		WHERE locks.expires_at < now()`,
+		name, ttl.Seconds(), token)
+	if err != nil || tag.RowsAffected() != 1 {
+		return "", err
+	}
+	return token, nil
+}
+
+func (s *PostgresStore) ReleaseLock(ctx context.Context, name string, token string) error {
+	_, err := s.pool.Exec(ctx, "DELETE FROM locks WHERE name = $1 AND token = $2", name, token)
+	return err
+}
+
+func (s *PostgresStore) SetHealthyProcessor(ctx context.Context, service string) error {
+	_, err := s.pool.Exec(ctx, `
+		INSERT INTO healthy_processor (id, service, updated_at) VALUES (1, $1, now())
+		ON CONFLICT (id) DO UPDATE SET service = EXCLUDED.service, updated_at = EXCLUDED.updated_at`, service)
+	return err
+}
+
+func (s *PostgresStore) GetHealthyProcessor(ctx context.Context) (string, error) {
+	var service string
+	err := s.pool.QueryRow(ctx, "SELECT service FROM healthy_processor WHERE id = 1").Scan(&service)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", nil
+	}
+	return service, err
+}
+
+func (s *PostgresStore) PurgeAllData(ctx context.Context) error {
+	_, err := s.pool.Exec(ctx, "TRUNCATE payments, accepted_payments, payment_transitions, processor_errors")
+	return err
+}
@@ -0,0 +1,281 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"rinha-backend-arthur/internal/keyspace"
+	"rinha-backend-arthur/internal/models"
+	"rinha-backend-arthur/internal/queue"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+// redisKeys are the store's keys in the deployment keyspace. Everything PurgeAllData
+// removes lives under payments*; the health keys are left alone.
+type redisKeys struct {
+	space            keyspace.Keyspace
+	payments         string
+	legacy           string // a legacy payments hash moved aside, until migrate drains it into the set
+	processorErrors  string
+	healthyProcessor string
+}
+
+func newRedisKeys(space keyspace.Keyspace) redisKeys {
+	return redisKeys{
+		space:            space,
+		payments:         space.Key("payments"),
+		legacy:           space.Key("payments", "legacy"),
+		processorErrors:  space.Key("payments", "metrics", "processor_errors"),
+		healthyProcessor: space.Key("healthy_processor_status"),
+	}
+}
+
+func (k redisKeys) stats(service string) string {
+	return k.space.Key("payments", "stats", service)
+}
+
+// buckets and bucketsComplete carry the bucket size, so changing SUMMARY_BUCKET_SIZE starts
+// new buckets instead of reading the old ones with the wrong boundaries.
+func (k redisKeys) buckets(size time.Duration, service string) string {
+	return k.space.Key("payments", "buckets", strconv.FormatInt(size.Nanoseconds(), 10), service)
+}
+
+// bucketsComplete exists once the buckets of that size count every payment in the payments set.
+func (k redisKeys) bucketsComplete(size time.Duration) string {
+	return k.space.Key("payments", "buckets", strconv.FormatInt(size.Nanoseconds(), 10), "complete")
+}
+
+// accepted and settled are one key per payment so each can expire, see RedisOptions.IdempotencyTTL.
+// Once they have, the same correlationId is accepted and counted again: the payments set is keyed by
+// the record, and a replay carries a new requestedAt.
+func (k redisKeys) accepted(correlationId uuid.UUID) string {
+	return k.space.Key("payments", "accepted", correlationId.String())
+}
+
+func (k redisKeys) settled(correlationId uuid.UUID) string {
+	return k.space.Key("payments", "settled", correlationId.String())
+}
+
+func (k redisKeys) status(correlationId uuid.UUID) string {
+	return k.space.Key("payments", "status", correlationId.String())
+}
+
+func (k redisKeys) lock(name string) string {
+	return k.space.Key(name)
+}
+
+// How RedisStore answers ranged summaries
+const (
+	RangeSummaryBuckets = "buckets" // pre-aggregated time buckets plus exact scans of the partial edges
+	RangeSummaryLua     = "lua"     // a script aggregating the payments set inside Redis
+	RangeSummaryScan    = "scan"    // fetch the payments in the range and sum them in Go
+)
+
+type RedisOptions struct {
+	SummaryBucketSize time.Duration // granularity of the summary buckets, each size has buckets of its own
+	RangeSummary      string
+	Keys              keyspace.Keyspace
+	IdempotencyTTL    time.Duration // how long accepted and settled correlationIds are remembered
+	// Queue, when it is a queue.ScriptedQueue, is enqueued to, acked and discarded from in the same
+	// scripts that accept, settle and discard payments. Other queues are left to the caller.
+	Queue queue.Queue
+}
+
+type RedisStore struct {
+	client          redis.UniversalClient
+	keys            redisKeys
+	bucketSize      time.Duration
+	bucketsComplete atomic.Bool // cached once seen, buckets never become incomplete again
+	rangeSummary    string
+	idempotencyTTL  time.Duration
+	queue           queue.ScriptedQueue // nil when the queue isn't in Redis
+}
+
+func NewRedisStore(client redis.UniversalClient, options RedisOptions) *RedisStore {
+	scripted, _ := options.Queue.(queue.ScriptedQueue)
+	return &RedisStore{
+		client:         client,
+		keys:           newRedisKeys(options.Keys),
+		bucketSize:     options.SummaryBucketSize,
+		rangeSummary:   options.RangeSummary,
+		idempotencyTTL: options.IdempotencyTTL,
+		queue:          scripted,
+	}
+}
+
+// acceptPaymentScript marks a correlationId as accepted and enqueues its message in one step,
+// so a crash can't leave a payment accepted but never queued.
+//
+// KEYS: accepted key, then the push keys (see queue.PushMode)
+// ARGV: idempotency TTL in milliseconds, push mode, then the push args
+var acceptPaymentScript = redis.NewScript(`
+if not redis.call('SET', KEYS[1], '1', 'NX', 'PX', ARGV[1]) then
+	return 0
+end
+
+local mode = ARGV[2]
+if mode == 'list' then
+	redis.call('LPUSH', KEYS[2], ARGV[3])
+elseif mode == 'stream' then
+	redis.call('XADD', KEYS[2], '*', ARGV[3], ARGV[4])
+end
+return 1
+`)
+
+// AcceptPayment records the correlationId at ingress and enqueues the payment in the same script
+// when the queue is in Redis too. It returns false when the payment was already accepted before.
+func (s *RedisStore) AcceptPayment(ctx context.Context, msg models.QueueMessage) (bool, bool, error) {
+	var push queue.PushSpec
+	if s.queue != nil {
+		var err error
+		if push, err = s.queue.PushSpec(msg); err != nil {
+			return false, false, err
+		}
+	}
+
+	keys := append([]string{s.keys.accepted(msg.CorrelationId)}, push.Keys...)
+	args := []any{s.idempotencyTTL.Milliseconds(), string(push.Mode)}
+	for _, arg := range push.Args {
+		args = append(args, arg)
+	}
+
+	accepted, err := acceptPaymentScript.Run(ctx, s.client, keys, args...).Int64()
+	if err != nil {
+		return false, false, fmt.Errorf("failed to accept payment: %w", err)
+	}
+	if accepted == 0 {
+		return false, false, nil
+	}
+	return true, push.Mode != queue.PushNone, nil
+}
+
+// UnmarkPaymentAccepted undoes AcceptPayment, used when the payment couldn't be enqueued.
+func (s *RedisStore) UnmarkPaymentAccepted(ctx context.Context, correlationId uuid.UUID) error {
+	return s.client.Del(ctx, s.keys.accepted(correlationId)).Err()
+}
+
+// discardPaymentScript removes a dead letter and forgets its correlationId in one step. It leaves
+// the correlationId alone when the dead letter is already gone, replayed or discarded by someone else.
+//
+// KEYS: accepted key, then the discard keys (see queue.DiscardMode)
+// ARGV: discard mode, then the discard args
+var discardPaymentScript = redis.NewScript(`
+if ARGV[1] == 'list' then
+	if redis.call('LREM', KEYS[2], 1, ARGV[2]) == 0 then
+		return 0
+	end
+end
+redis.call('DEL', KEYS[1])
+return 1
+`)
+
+// DiscardPayment removes the dead letter and forgets the correlationId in one script when the queue
+// is in Redis too. It leaves the correlationId alone and reports false when there is no such dead letter.
+func (s *RedisStore) DiscardPayment(ctx context.Context, correlationId uuid.UUID) (bool, error) {
+	var discard queue.DiscardSpec
+	if s.queue != nil {
+		var found bool
+		var err error
+		if discard, found, err = s.queue.DiscardSpec(ctx, correlationId); err != nil || !found {
+			return false, err
+		}
+	}
+
+	keys := append([]string{s.keys.accepted(correlationId)}, discard.Keys...)
+	args := []any{string(discard.Mode)}
+	for _, arg := range discard.Args {
+		args = append(args, arg)
+	}
+
+	removed, err := discardPaymentScript.Run(ctx, s.client, keys, args...).Int64()
+	if err != nil {
+		return false, fmt.Errorf("failed to discard payment: %w", err)
+	}
+	return removed == 1 && discard.Mode != queue.DiscardNone, nil
+}
+
+func (s *RedisStore) IsPaymentSettled(ctx context.Context, correlationId uuid.UUID) (bool, error) {
+	n, err := s.client.Exists(ctx, s.keys.settled(correlationId)).Result()
+	return n == 1, err
+}
+
+// StorePayment records a processed payment that isn't tied to a queue delivery.
+func (s *RedisStore) StorePayment(ctx context.Context, payment models.Payment) error {
+	_, err := s.SettlePayment(ctx, payment, queue.Delivery{})
+	return err
+}
+
+func (s *RedisStore) GetPaymentSummaryDirect(ctx context.Context) (models.PaymentSummaryResponse, error) {
+	// Get stats for both processors in a single pipeline
+	pipe := s.client.Pipeline()
+	defaultStats := pipe.HGetAll(ctx, s.keys.stats("default"))
+	fallbackStats := pipe.HGetAll(ctx, s.keys.stats("fallback"))
+
+	_, err := pipe.Exec(ctx)
+	if err != nil {
+		return models.PaymentSummaryResponse{}, fmt.Errorf("failed to retrieve payment stats: %w", err)
+	}
+
+	// Process default stats
+	defaultResult, _ := defaultStats.Result()
+	defaultCount, _ := strconv.ParseInt(defaultResult["count"], 10, 64)
+	defaultAmount, _ := strconv.ParseInt(defaultResult["amount"], 10, 64)
+
+	// Process fallback stats
+	fallbackResult, _ := fallbackStats.Result()
+	fallbackCount, _ := strconv.ParseInt(fallbackResult["count"], 10, 64)
+	fallbackAmount, _ := strconv.ParseInt(fallbackResult["amount"], 10, 64)
+
+	return models.PaymentSummaryResponse{
+		Default: models.SummaryResponse{
+			TotalRequests: defaultCount,
+			TotalAmount:   models.Money(defaultAmount),
+		},
+		Fallback: models.SummaryResponse{
+			TotalRequests: fallbackCount,
+			TotalAmount:   models.Money(fallbackAmount),
+		},
+	}, nil
+}
+
+func (s *RedisStore) GetPaymentsByTime(ctx context.Context, from, to time.Time) ([]models.Payment, error) {
+	minScore, maxScore := paymentScoreRange(from, to)
+	results, err := s.client.ZRangeByScore(ctx, s.keys.payments, &redis.ZRangeBy{
+		Min: minScore,
+		Max: maxScore,
+	}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve payments: %w", err)
+	}
+	var payments []models.Payment
+	for _, member := range results {
+		payment, err := models.DecodePaymentRecord([]byte(member))
+		if err != nil {
+			continue // Skip invalid data
+		}
+		payments = append(payments, payment)
+	}
+	return payments, nil
+}
+
+// paymentScoreRange formats a time range as payments set scores.
+func paymentScoreRange(from, to time.Time) (string, string) {
+	return fmt.Sprintf("%f", float64(from.UnixNano())), fmt.Sprintf("%f", float64(to.UnixNano()))
+}
+
+// PurgeAllData deletes every payments* key of the deployment: the payments set, stats,
+// buckets, idempotency sets, counters and one status record per payment.
+func (s *RedisStore) PurgeAllData(ctx context.Context) error {
+	if _, err := keyspace.Delete(ctx, s.client, s.keys.space.Match("payments")); err != nil {
+		return fmt.Errorf("failed to purge payments data: %w", err)
+	}
+	// Nothing left to count, the buckets are complete again
+	if err := s.client.Set(ctx, s.keys.bucketsComplete(s.bucketSize), "1", 0).Err(); err != nil {
+		return fmt.Errorf("failed to purge payments data: %w", err)
+	}
+	return nil
+}
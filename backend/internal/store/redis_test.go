@@ -0,0 +1,111 @@
+package store
+
+import (
+	"context"
+	"rinha-backend-arthur/internal/models"
+	"rinha-backend-arthur/internal/queue"
+	"rinha-backend-arthur/internal/redistest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type scriptedTestQueue interface {
+	queue.Queue
+	queue.DeadLetterQueue
+}
+
+// TestRedisStoreUpdatesItsQueue accepts, settles and discards payments through the store, which runs
+// the queue commands in its own scripts when the queue is in Redis and leaves them to the caller otherwise.
+func TestRedisStoreUpdatesItsQueue(t *testing.T) {
+	for _, backend := range []string{"list", "stream", "memory"} {
+		t.Run(backend, func(t *testing.T) {
+			ctx := context.Background()
+			client, keys := redistest.Client(t)
+
+			var q scriptedTestQueue
+			switch backend {
+			case "list":
+				q = queue.NewRedisListQueue(client, keys)
+			case "stream":
+				streamQueue, err := queue.NewRedisStreamQueue(ctx, client, keys, "test")
+				if err != nil {
+					t.Fatal(err)
+				}
+				q = streamQueue
+			default:
+				q = queue.NewMemoryQueue(10)
+			}
+			_, scripted := q.(queue.ScriptedQueue)
+			s := NewRedisStore(client, RedisOptions{SummaryBucketSize: time.Second, Keys: keys, IdempotencyTTL: time.Hour, Queue: q})
+
+			accept := func(correlationId uuid.UUID) queue.Delivery {
+				t.Helper()
+				msg := models.QueueMessage{CorrelationId: correlationId, Payload: []byte(`{}`)}
+				accepted, pushed, err := s.AcceptPayment(ctx, msg)
+				if err != nil || !accepted || pushed != scripted {
+					t.Fatalf("AcceptPayment = %v, %v, %v, want accepted and pushed %v", accepted, pushed, err, scripted)
+				}
+				if !pushed {
+					if err := q.Enqueue(ctx, msg); err != nil {
+						t.Fatal(err)
+					}
+				}
+				deliveries, err := q.Dequeue(ctx, 0, 1, time.Second)
+				if err != nil || len(deliveries) != 1 || deliveries[0].Message.CorrelationId != correlationId {
+					t.Fatalf("Dequeue = %v, %v, want the accepted payment", deliveries, err)
+				}
+				return deliveries[0]
+			}
+
+			settledId := uuid.New()
+			delivery := accept(settledId)
+			if accepted, _, err := s.AcceptPayment(ctx, models.QueueMessage{CorrelationId: settledId}); err != nil || accepted {
+				t.Fatalf("replayed AcceptPayment = %v, %v", accepted, err)
+			}
+			payment := models.Payment{
+				PaymentRequest: models.PaymentRequest{CorrelationId: settledId, Amount: 1990, RequestedAt: time.Now().UTC()},
+				Service:        "default",
+			}
+			acked, err := s.SettlePayment(ctx, payment, delivery)
+			if err != nil || acked != scripted {
+				t.Fatalf("SettlePayment = %v, %v, want acked %v", acked, err, scripted)
+			}
+			if !acked {
+				q.Ack(ctx, delivery)
+			}
+			if depth, _ := q.Depth(ctx); depth != (models.QueueMetrics{}) {
+				t.Fatalf("queue after settling = %+v, want it empty", depth)
+			}
+
+			deadId := uuid.New()
+			if err := q.DeadLetter(ctx, accept(deadId)); err != nil {
+				t.Fatal(err)
+			}
+			discarded, err := s.DiscardPayment(ctx, deadId)
+			if err != nil || discarded != scripted {
+				t.Fatalf("DiscardPayment = %v, %v, want discarded %v", discarded, err, scripted)
+			}
+			if !discarded {
+				q.DiscardDeadLetter(ctx, deadId)
+			}
+			if msg, _ := q.GetDeadLetter(ctx, deadId); msg != nil {
+				t.Fatal("dead letter is still there after discarding it")
+			}
+
+			// The correlationId was forgotten, the payment can be submitted again
+			accept(deadId)
+
+			// Nothing is forgotten when the dead letter is already gone
+			if scripted {
+				if discarded, err := s.DiscardPayment(ctx, deadId); err != nil || discarded {
+					t.Fatalf("DiscardPayment without a dead letter = %v, %v", discarded, err)
+				}
+				if accepted, _, _ := s.AcceptPayment(ctx, models.QueueMessage{CorrelationId: deadId}); accepted {
+					t.Fatal("payment without a dead letter was forgotten")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"rinha-backend-arthur/internal/models"
+	"rinha-backend-arthur/internal/queue"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// settlePaymentScript records a payment, bumps the service counters and its time bucket, marks the
+// correlationId as settled and acks the queue entry in one step, so a crash can't leave only part of it done.
+// A correlationId that is already settled is only acked. The first payment into an empty set
+// marks the buckets complete, there is nothing older for them to miss. A legacy payments hash
+// is moved aside first, so settling works before the migrate command ran.
+//
+// KEYS: payments set, stats hash, settled key, buckets hash, buckets complete key, legacy hash, then the ack keys (see queue.AckMode)
+// ARGV: idempotency TTL in milliseconds, payment record, score, amount in cents, bucket, ack mode, then the ack args
+var settlePaymentScript = redis.NewScript(moveLegacyPaymentsLua + `
+local function ack()
+	local mode = ARGV[6]
+	if mode == 'list' then
+		redis.call('LREM', KEYS[7], 1, ARGV[7])
+		redis.call('ZREM', KEYS[8], ARGV[8])
+	elseif mode == 'stream' then
+		redis.call('XACK', KEYS[7], ARGV[7], ARGV[8])
+		redis.call('XDEL', KEYS[7], ARGV[8])
+	end
+end
+
+moveLegacyPayments(KEYS[1], KEYS[6])
+
+if not redis.call('SET', KEYS[3], '1', 'NX', 'PX', ARGV[1]) then
+	ack()
+	return 0
+end
+
+if redis.call('ZCARD', KEYS[1]) == 0 then
+	redis.call('SET', KEYS[5], '1')
+end
+redis.call('ZADD', KEYS[1], ARGV[3], ARGV[2])
+redis.call('HINCRBY', KEYS[2], 'count', 1)
+redis.call('HINCRBY', KEYS[2], 'amount', ARGV[4])
+redis.call('HINCRBY', KEYS[4], ARGV[5] .. ':count', 1)
+redis.call('HINCRBY', KEYS[4], ARGV[5] .. ':amount', ARGV[4])
+ack()
+return 1
+`)
+
+// SettlePayment atomically records a processed payment and acks its queue delivery.
+// It returns ErrPaymentAlreadyStored, after acking, when the correlationId was already settled.
+// When the queue isn't in Redis nothing is acked, it reports false and the caller has to ack through the queue.
+func (s *RedisStore) SettlePayment(ctx context.Context, payment models.Payment, delivery queue.Delivery) (bool, error) {
+	var ack queue.AckSpec
+	if s.queue != nil {
+		ack = s.queue.AckSpec(delivery)
+	}
+
+	// The payments set member is the binary record, it carries everything a range query needs
+	record, err := models.EncodePaymentRecord(payment)
+	if err != nil {
+		return false, fmt.Errorf("failed to encode payment: %w", err)
+	}
+
+	keys := append([]string{
+		s.keys.payments,
+		s.keys.stats(payment.Service),
+		s.keys.settled(payment.CorrelationId),
+		s.keys.buckets(s.bucketSize, payment.Service),
+		s.keys.bucketsComplete(s.bucketSize),
+		s.keys.legacy,
+	}, ack.Keys...)
+
+	args := []any{
+		s.idempotencyTTL.Milliseconds(),
+		record,
+		payment.RequestedAt.UnixNano(),
+		payment.Amount.Cents(),
+		s.bucketOf(payment.RequestedAt.UnixNano()),
+		string(ack.Mode),
+	}
+	for _, arg := range ack.Args {
+		args = append(args, arg)
+	}
+
+	stored, err := settlePaymentScript.Run(ctx, s.client, keys, args...).Int64()
+	if err != nil {
+		return false, fmt.Errorf("failed to store payment: %w", err)
+	}
+
+	acked := ack.Mode != queue.AckNone
+	if stored == 0 {
+		return acked, ErrPaymentAlreadyStored
+	}
+
+	return acked, nil
+}
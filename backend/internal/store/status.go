@@ -0,0 +1,83 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"rinha-backend-arthur/internal/models"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const paymentStatusTTL = 24 * time.Hour
+
+// RecordPaymentTransition appends a lifecycle transition to the payment status record.
+func (s *RedisStore) RecordPaymentTransition(ctx context.Context, correlationId uuid.UUID, transition models.PaymentTransition) error {
+	if transition.At.IsZero() {
+		transition.At = time.Now().UTC()
+	}
+
+	transitionJSON, err := json.Marshal(transition)
+	if err != nil {
+		return fmt.Errorf("failed to marshal payment transition: %w", err)
+	}
+
+	key := s.keys.status(correlationId)
+	pipe := s.client.Pipeline()
+	pipe.RPush(ctx, key, transitionJSON)
+	pipe.Expire(ctx, key, paymentStatusTTL)
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to record payment transition: %w", err)
+	}
+
+	return nil
+}
+
+// GetPaymentStatus builds the current status of a payment from its transitions.
+// It returns nil when the payment is unknown.
+func (s *RedisStore) GetPaymentStatus(ctx context.Context, correlationId uuid.UUID) (*models.PaymentStatusResponse, error) {
+	results, err := s.client.LRange(ctx, s.keys.status(correlationId), 0, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve payment status: %w", err)
+	}
+
+	if len(results) == 0 {
+		return nil, nil
+	}
+
+	transitions := make([]models.PaymentTransition, 0, len(results))
+	for _, transitionJSON := range results {
+		var transition models.PaymentTransition
+		if err := json.Unmarshal([]byte(transitionJSON), &transition); err != nil {
+			continue // Skip malformed data
+		}
+		transitions = append(transitions, transition)
+	}
+
+	return buildPaymentStatus(correlationId, transitions), nil
+}
+
+// buildPaymentStatus folds the transitions, oldest first, into the current status.
+func buildPaymentStatus(correlationId uuid.UUID, transitions []models.PaymentTransition) *models.PaymentStatusResponse {
+	status := &models.PaymentStatusResponse{
+		CorrelationId: correlationId,
+		Transitions:   transitions,
+	}
+
+	for _, transition := range transitions {
+		status.Status = transition.Status
+		if transition.Worker != nil {
+			status.Worker = transition.Worker
+		}
+		if transition.Processor != "" {
+			status.Processor = transition.Processor
+		}
+		if transition.Status == models.PaymentStatusProcessing {
+			status.Attempts++
+		}
+	}
+
+	return status
+}
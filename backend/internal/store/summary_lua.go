@@ -0,0 +1,136 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"rinha-backend-arthur/internal/models"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// rangeSummaryScript sums the binary records of the payments set between two requestedAt values
+// inside Redis and returns only the count and amount per processor. Scores are widened by the
+// caller and lose precision at nanosecond scale, so the requestedAt in the record decides, compared
+// as high and low 32-bit halves since Lua numbers are doubles. Amounts are summed the same way and
+// put back together in Go, which keeps int64 totals exact. Legacy JSON members are returned as they
+// are, for Go to decode like every other read: only stores not migrated yet have them.
+//
+// KEYS: payments set
+// ARGV: min score, max score, from high, from low, to high, to low
+// Reply: default count, high, low, fallback count, high, low, then the legacy members
+var rangeSummaryScript = redis.NewScript(`
+local half = 4294967296
+
+local function word(member, first)
+	local value = 0
+	for i = first, first + 3 do
+		value = value * 256 + string.byte(member, i)
+	end
+	return value
+end
+
+local function signedWord(member, first)
+	local value = word(member, first)
+	if value >= 2147483648 then
+		value = value - half
+	end
+	return value
+end
+
+local fromHigh, fromLow = tonumber(ARGV[3]), tonumber(ARGV[4])
+local toHigh, toLow = tonumber(ARGV[5]), tonumber(ARGV[6])
+
+local function inRange(high, low)
+	if high < fromHigh or (high == fromHigh and low < fromLow) then
+		return false
+	end
+	return high < toHigh or (high == toHigh and low <= toLow)
+end
+
+local processors = {'default', 'fallback'}
+local totals = {default = {0, 0, 0}, fallback = {0, 0, 0}}
+local legacy = {}
+
+for _, member in ipairs(redis.call('ZRANGEBYSCORE', KEYS[1], ARGV[1], ARGV[2])) do
+	local version = string.byte(member, 1)
+	-- Binary record: version 1, correlationId, big-endian int64 cents, int64 nanos, processor id
+	if version == 1 and #member == 34 and inRange(signedWord(member, 26), word(member, 30)) then
+		local t = totals[processors[string.byte(member, 34)] or '']
+		if t then
+			t[1] = t[1] + 1
+			t[2] = t[2] + signedWord(member, 18)
+			t[3] = t[3] + word(member, 22)
+			-- Carry so the low half stays exact
+			if t[3] >= half then
+				local carry = math.floor(t[3] / half)
+				t[2] = t[2] + carry
+				t[3] = t[3] - carry * half
+			end
+		end
+	elseif version == 0 or version == 123 then
+		-- Version 0 JSON, tagged or from before version bytes
+		table.insert(legacy, member)
+	end
+end
+
+local d, f = totals.default, totals.fallback
+local reply = {d[1], d[2], d[3], f[1], f[2], f[3]}
+for _, member in ipairs(legacy) do
+	table.insert(reply, member)
+end
+return reply
+`)
+
+// luaSummary aggregates a range on the Redis side, so only six numbers come back whatever the
+// number of payments. The script holds Redis while it runs, so very wide ranges delay other commands.
+func (s *RedisStore) luaSummary(ctx context.Context, from, to time.Time) (models.PaymentSummaryResponse, error) {
+	fromNs, toNs := from.UnixNano(), to.UnixNano()
+	if fromNs > toNs {
+		return models.PaymentSummaryResponse{}, nil
+	}
+	minScore, maxScore := paymentScoreRange(time.Unix(0, fromNs-bucketScoreSlack), time.Unix(0, toNs+bucketScoreSlack))
+
+	reply, err := rangeSummaryScript.Run(ctx, s.client, []string{s.keys.payments},
+		minScore, maxScore, fromNs>>32, fromNs&(1<<32-1), toNs>>32, toNs&(1<<32-1),
+	).Slice()
+	if err != nil {
+		return models.PaymentSummaryResponse{}, fmt.Errorf("failed to aggregate payments: %w", err)
+	}
+	if len(reply) < 6 {
+		return models.PaymentSummaryResponse{}, fmt.Errorf("unexpected aggregation reply: %v", reply)
+	}
+	totals := make([]int64, 6)
+	for i := range totals {
+		n, ok := reply[i].(int64)
+		if !ok {
+			return models.PaymentSummaryResponse{}, fmt.Errorf("unexpected aggregation reply: %v", reply[:6])
+		}
+		totals[i] = n
+	}
+
+	// Wraps around like summing the int64 amounts in Go does
+	summary := models.PaymentSummaryResponse{
+		Default: models.SummaryResponse{
+			TotalRequests: totals[0],
+			TotalAmount:   models.Money(totals[1]<<32 + totals[2]),
+		},
+		Fallback: models.SummaryResponse{
+			TotalRequests: totals[3],
+			TotalAmount:   models.Money(totals[4]<<32 + totals[5]),
+		},
+	}
+
+	var legacy []models.Payment
+	for _, member := range reply[6:] {
+		record, _ := member.(string)
+		payment, err := models.DecodePaymentRecord([]byte(record))
+		if err != nil {
+			continue // Skip invalid data
+		}
+		if requestedAt := payment.RequestedAt.UnixNano(); requestedAt >= fromNs && requestedAt <= toNs {
+			legacy = append(legacy, payment)
+		}
+	}
+	return addSummaries(summary, summarizePayments(legacy)), nil
+}
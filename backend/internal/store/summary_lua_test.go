@@ -0,0 +1,180 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"rinha-backend-arthur/internal/models"
+	"rinha-backend-arthur/internal/redistest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+// The Lua summary has to read binary records exactly like models.DecodePaymentRecord and apply the
+// exact requestedAt edges of scanSummary. miniredis runs the script on another Lua, so run this
+// against a real server too:
+//
+//	TEST_REDIS_URL=redis://localhost:6379 go test ./internal/store -run LuaSummary
+
+var summaryFixtureBase = time.Date(2025, 7, 1, 12, 0, 0, 0, time.UTC)
+
+func v1Record(t *testing.T, service string, cents int64, requestedAt time.Time) string {
+	t.Helper()
+	record, err := models.EncodePaymentRecord(models.Payment{
+		PaymentRequest: models.PaymentRequest{CorrelationId: uuid.New(), Amount: models.Money(cents), RequestedAt: requestedAt},
+		Service:        service,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(record)
+}
+
+func v0Record(correlationId string, amount string, processor string, requestedAt string) string {
+	return fmt.Sprintf(`{"correlationId":%q,"amount":%s,"paymentProcessor":%q,"requestedAt":%q}`,
+		correlationId, amount, processor, requestedAt)
+}
+
+// summaryFixtures returns payments set members with their scores, in nanoseconds from summaryFixtureBase.
+func summaryFixtures(t *testing.T) map[string]int64 {
+	id := uuid.NewString()
+	at := summaryFixtureBase.Add(5 * time.Second).Format(time.RFC3339Nano)
+	corrupt := []byte(v1Record(t, "default", 100, summaryFixtureBase))
+
+	fixtures := map[string]int64{
+		// Current records, on and just past the range boundaries
+		v1Record(t, "default", 1990, summaryFixtureBase):                          0,
+		v1Record(t, "fallback", 1, summaryFixtureBase.Add(time.Second)):           int64(time.Second),
+		v1Record(t, "default", 250, summaryFixtureBase.Add(10*time.Second)):       int64(10 * time.Second),
+		v1Record(t, "default", 999, summaryFixtureBase.Add(-time.Millisecond)):    -int64(time.Millisecond),
+		v1Record(t, "fallback", 999, summaryFixtureBase.Add(10*time.Second+1e6)):  int64(10*time.Second + 1e6),
+		v1Record(t, "default", -50, summaryFixtureBase.Add(2*time.Second)):        int64(2 * time.Second),
+		v1Record(t, "default", 1<<40, summaryFixtureBase.Add(3*time.Second)):      int64(3 * time.Second),
+		v1Record(t, "fallback", 123456789, summaryFixtureBase.Add(4*time.Second)): int64(4 * time.Second),
+
+		// Totals past what a double holds exactly, and wrapping around
+		v1Record(t, "fallback", math.MaxInt64, summaryFixtureBase.Add(7*time.Second)):   int64(7 * time.Second),
+		v1Record(t, "fallback", math.MaxInt64-1, summaryFixtureBase.Add(7*time.Second)): int64(7 * time.Second),
+		v1Record(t, "default", math.MinInt64, summaryFixtureBase.Add(7*time.Second)):    int64(7 * time.Second),
+		v1Record(t, "default", 1<<53+1, summaryFixtureBase.Add(7*time.Second)):          int64(7 * time.Second),
+
+		// A nanosecond outside the range, with the same float64 score as its edge
+		v1Record(t, "default", 7, summaryFixtureBase.Add(-time.Nanosecond)):                -1,
+		v1Record(t, "fallback", 7, summaryFixtureBase.Add(10*time.Second+time.Nanosecond)): int64(10*time.Second) + 1,
+		v1Record(t, "fallback", 3, summaryFixtureBase.Add(10*time.Second-time.Nanosecond)): int64(10*time.Second) - 1,
+		v1Record(t, "default", 11, time.Unix(0, -int64(time.Second)).UTC()):                -summaryFixtureBase.UnixNano() - int64(time.Second),
+
+		// Malformed current records
+		string(append(corrupt, 0)):            int64(time.Second),
+		string(corrupt[:len(corrupt)-1]):      int64(time.Second),
+		string(append(corrupt[:33:33], 7)):    int64(time.Second),
+		"\x01":                                int64(time.Second),
+		"\x02" + string(corrupt[1:]):          int64(time.Second),
+		"not a record":                        int64(time.Second),
+		string([]byte{0xff, 0xfe, 0x00, 0x1}): int64(time.Second),
+
+		// Legacy JSON records
+		v0Record(uuid.NewString(), "1990", "default", at):                                                         int64(5 * time.Second),
+		v0Record(uuid.NewString(), "1990.5", "default", at):                                                       int64(5 * time.Second),
+		v0Record(uuid.NewString(), "1990.49", "fallback", at):                                                     int64(5 * time.Second),
+		v0Record(uuid.NewString(), "-3.5", "fallback", at):                                                        int64(5 * time.Second),
+		v0Record(uuid.NewString(), "1e3", "default", at):                                                          int64(5 * time.Second),
+		v0Record(uuid.NewString(), "0.49999999999999994", "default", at):                                          int64(5 * time.Second),
+		v0Record(uuid.NewString(), "-0.49999999999999994", "fallback", at):                                        int64(5 * time.Second),
+		v0Record(uuid.NewString(), "0.5", "fallback", at):                                                         int64(5 * time.Second),
+		v0Record(uuid.NewString(), "-0.5", "default", at):                                                         int64(5 * time.Second),
+		v0Record(uuid.NewString(), "2.5", "fallback", at):                                                         int64(5 * time.Second),
+		v0Record(uuid.NewString(), "1.4999999999999998", "default", at):                                           int64(5 * time.Second),
+		v0Record(uuid.NewString(), "4503599627370495.5", "default", at):                                           int64(5 * time.Second),
+		v0Record(uuid.NewString(), "9007199254740992", "fallback", at):                                            int64(5 * time.Second),
+		"\x00" + v0Record(uuid.NewString(), "42", "fallback", at):                                                 int64(5 * time.Second),
+		v0Record("urn:uuid:"+id, "10", "default", at):                                                             int64(5 * time.Second),
+		v0Record("URN:UUID:"+id, "10", "default", at):                                                             int64(5 * time.Second),
+		v0Record("{"+id+"}", "10", "fallback", at):                                                                int64(5 * time.Second),
+		v0Record(uuid.New().String()[:8]+uuid.New().String()[9:13]+"0000000000000000000000", "10", "default", at): int64(5 * time.Second),
+		v0Record(uuid.NewString(), "10", "default", "2025-07-01T12:00:00.123456789-03:00"):                        int64(5 * time.Second),
+		v0Record(uuid.NewString(), "10", "default", "2024-02-29T23:59:59Z"):                                       int64(5 * time.Second),
+		v0Record(uuid.NewString(), "10", "default", "2025-07-01T12:00:00,5Z"):                                     int64(5 * time.Second),
+		v0Record(uuid.NewString(), "10", "default", "2025-07-01t12:00:00z"):                                       int64(5 * time.Second),
+		v0Record(uuid.NewString(), "10", "other", at):                                                             int64(5 * time.Second),
+
+		// Malformed legacy records
+		v0Record(uuid.NewString(), `"10"`, "default", at):                         int64(6 * time.Second),
+		v0Record(uuid.NewString(), "null", "default", at):                         int64(6 * time.Second),
+		v0Record("not-a-uuid", "10", "default", at):                               int64(6 * time.Second),
+		v0Record(id[:35]+"g", "10", "default", at):                                int64(6 * time.Second),
+		v0Record(uuid.NewString(), "10", "default", "2025-02-29T12:00:00Z"):       int64(6 * time.Second),
+		v0Record(uuid.NewString(), "10", "default", "2025-13-01T12:00:00Z"):       int64(6 * time.Second),
+		v0Record(uuid.NewString(), "10", "default", "2025-07-01T24:00:00Z"):       int64(6 * time.Second),
+		v0Record(uuid.NewString(), "10", "default", "2025-07-01T12:00:60Z"):       int64(6 * time.Second),
+		v0Record(uuid.NewString(), "10", "default", "2025-07-01T12:00:00"):        int64(6 * time.Second),
+		v0Record(uuid.NewString(), "10", "default", "2025-07-01T12:00:00+24:00"):  int64(6 * time.Second),
+		v0Record(uuid.NewString(), "10", "default", "2025-07-01 12:00:00Z"):       int64(6 * time.Second),
+		`{"correlationId":"` + id + `","amount":10,"paymentProcessor":"default"}`: int64(6 * time.Second),
+		`{"correlationId":"` + id + `","amount":10`:                               int64(6 * time.Second),
+		v0Record(uuid.NewString(), "9007199254740993", "default", at):             int64(6 * time.Second),
+		v0Record(uuid.NewString(), "-1e300", "default", at):                       int64(6 * time.Second),
+		v0Record(uuid.NewString(), "1e400", "default", at):                        int64(6 * time.Second),
+		v0Record(uuid.NewString(), "10", "default", "2025-07-01T1:00:00Z"):        int64(6 * time.Second),
+		v0Record(uuid.NewString(), "10", "default", "2025-07-01T12:00:00.Z"):      int64(6 * time.Second),
+		v0Record(uuid.NewString(), "10", "default", "2025-07-01T12:00:00+05:60"):  int64(6 * time.Second),
+		"\x00 " + v0Record(uuid.NewString(), "42", "fallback", at):                int64(6 * time.Second),
+		"\x00":           int64(6 * time.Second),
+		`{}`:             int64(6 * time.Second),
+		`{"amount":[1]}`: int64(6 * time.Second),
+		`[]`:             int64(6 * time.Second),
+	}
+	return fixtures
+}
+
+func TestLuaSummaryMatchesGo(t *testing.T) {
+	client, keys := redistest.Client(t)
+	ctx := context.Background()
+	s := NewRedisStore(client, RedisOptions{SummaryBucketSize: time.Second, Keys: keys})
+
+	var members []redis.Z
+	for member, offset := range summaryFixtures(t) {
+		members = append(members, redis.Z{Score: float64(summaryFixtureBase.UnixNano() + offset), Member: member})
+	}
+	if err := client.ZAdd(ctx, s.keys.payments, members...).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	ranges := []struct {
+		name     string
+		from, to time.Time
+	}{
+		{"boundaries", summaryFixtureBase, summaryFixtureBase.Add(10 * time.Second)},
+		{"inner", summaryFixtureBase.Add(time.Nanosecond), summaryFixtureBase.Add(10*time.Second - time.Nanosecond)},
+		{"legacy only", summaryFixtureBase.Add(5 * time.Second), summaryFixtureBase.Add(6 * time.Second)},
+		{"before the epoch", time.Unix(0, -int64(time.Hour)), time.Unix(0, 0)},
+		{"everything", summaryFixtureBase.Add(-time.Hour), summaryFixtureBase.Add(time.Hour)},
+		{"single instant", summaryFixtureBase.Add(time.Second), summaryFixtureBase.Add(time.Second)},
+		{"empty", summaryFixtureBase.Add(time.Hour), summaryFixtureBase.Add(2 * time.Hour)},
+		{"reversed", summaryFixtureBase.Add(10 * time.Second), summaryFixtureBase},
+	}
+
+	for _, r := range ranges {
+		t.Run(r.name, func(t *testing.T) {
+			lua, err := s.luaSummary(ctx, r.from, r.to)
+			if err != nil {
+				t.Fatal(err)
+			}
+			scan, err := s.scanSummary(ctx, r.from.UnixNano(), r.to.UnixNano())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			luaJSON, _ := json.Marshal(lua)
+			goJSON, _ := json.Marshal(scan)
+			if !bytes.Equal(luaJSON, goJSON) {
+				t.Fatalf("lua summary %s, go summary %s", luaJSON, goJSON)
+			}
+		})
+	}
+}
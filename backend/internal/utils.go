@@ -2,33 +2,9 @@ package internal
 
 import (
 	"fmt"
-	"rinha-backend-arthur/internal/models"
 	"time"
 )
 
-func buildSummary(payments []models.Payment) models.PaymentSummary {
-	summary := models.PaymentSummary{
-		Default:  models.Summary{},
-		Fallback: models.Summary{},
-	}
-
-	for _, payment := range payments {
-		switch payment.Service {
-		case "default":
-			summary.Default.TotalRequests++
-			summary.Default.TotalAmount += payment.Amount
-		case "fallback":
-			summary.Fallback.TotalRequests++
-			summary.Fallback.TotalAmount += payment.Amount
-		}
-	}
-
-	// Round to 2 decimal places to match payment processor behavior
-	// summary.Default.TotalAmount = math.Round(summary.Default.TotalAmount*100) / 100
-	// summary.Fallback.TotalAmount = math.Round(summary.Fallback.TotalAmount*100) / 100
-
-	return summary
-}
 func parseTimeRange(fromStr, toStr string) (from, to time.Time, err error) {
 	if fromStr == "" && toStr == "" {
 		return // Both zero values means no filtering
@@ -55,27 +31,6 @@ func parseTimeRange(fromStr, toStr string) (from, to time.Time, err error) {
 	return from, to, nil
 }
 
-func PaymentsToSummary(payments []models.Payment, from, to time.Time) models.PaymentSummary {
-	validPayments := []models.Payment{}
-
-	isTimeRangeSet := !from.IsZero() && !to.IsZero()
-
-	for _, payment := range payments {
-		include := true
-
-		if isTimeRangeSet && (payment.RequestedAt.Before(from) || payment.RequestedAt.After(to)) {
-			include = false
-		}
-
-		if include {
-			validPayments = append(validPayments, payment)
-		}
-	}
-
-	summary := buildSummary(validPayments)
-	return summary
-}
-
 func ParseFlexibleTime(timeStr string) (time.Time, error) {
 	if timeStr == "" {
 		return time.Time{}, nil
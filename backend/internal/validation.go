@@ -0,0 +1,122 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/big"
+	"rinha-backend-arthur/internal/models"
+	"sort"
+
+	"github.com/google/uuid"
+	"github.com/valyala/fasthttp"
+)
+
+var allowedPaymentFields = map[string]bool{
+	"correlationId": true,
+	"amount":        true,
+}
+
+// validatePaymentPayload checks the body of a POST /payments before it is enqueued.
+// It returns the parsed correlationId, the HTTP status to answer with (0 when the payload
+// is valid) and the error body.
+func validatePaymentPayload(body []byte) (uuid.UUID, int, models.ErrorResponse) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(body, &raw); err != nil || raw == nil {
+		return uuid.Nil, fasthttp.StatusBadRequest, models.ErrorResponse{
+			Error: "request body must be a JSON object",
+		}
+	}
+
+	var fieldErrors []models.FieldError
+
+	unknownFields := []string{}
+	for field := range raw {
+		if !allowedPaymentFields[field] {
+			unknownFields = append(unknownFields, field)
+		}
+	}
+	sort.Strings(unknownFields)
+	for _, field := range unknownFields {
+		fieldErrors = append(fieldErrors, models.FieldError{Field: field, Message: "unknown field"})
+	}
+
+	correlationId, msg := validateCorrelationId(raw["correlationId"])
+	if msg != "" {
+		fieldErrors = append(fieldErrors, models.FieldError{Field: "correlationId", Message: msg})
+	}
+
+	if msg := validateAmount(raw["amount"]); msg != "" {
+		fieldErrors = append(fieldErrors, models.FieldError{Field: "amount", Message: msg})
+	}
+
+	if len(fieldErrors) > 0 {
+		return uuid.Nil, fasthttp.StatusUnprocessableEntity, models.ErrorResponse{
+			Error:  "invalid payment payload",
+			Fields: fieldErrors,
+		}
+	}
+
+	return correlationId, 0, models.ErrorResponse{}
+}
+
+func validateCorrelationId(raw json.RawMessage) (uuid.UUID, string) {
+	if raw == nil {
+		return uuid.Nil, "is required"
+	}
+
+	var value string
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return uuid.Nil, "must be a string"
+	}
+
+	correlationId, err := uuid.Parse(value)
+	if err != nil {
+		return uuid.Nil, "must be a valid UUID"
+	}
+	if correlationId == uuid.Nil {
+		// Every client sending the nil UUID would share one idempotency key
+		return uuid.Nil, "must not be the nil UUID"
+	}
+
+	return correlationId, ""
+}
+
+func validateAmount(raw json.RawMessage) string {
+	if raw == nil {
+		return "is required"
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return "must be a number"
+	}
+
+	number, ok := value.(json.Number)
+	if !ok {
+		return "must be a number"
+	}
+
+	// Validate what the handler will store, anything ParseMoney rejects would be dropped after the 202
+	amount, err := models.ParseMoney(number.String())
+	if err != nil {
+		return "is out of range"
+	}
+
+	// Check the decimal places on the exact literal, ParseMoney rounds fractions of a cent
+	exact, ok := new(big.Rat).SetString(number.String())
+	if !ok {
+		return "must be a number"
+	}
+	if !exact.Mul(exact, big.NewRat(100, 1)).IsInt() {
+		return "must have at most 2 decimal places"
+	}
+
+	if amount <= 0 {
+		return "must be greater than zero"
+	}
+
+	return ""
+}
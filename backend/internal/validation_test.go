@@ -0,0 +1,127 @@
+package internal
+
+import (
+	"encoding/json"
+	"rinha-backend-arthur/internal/distributor"
+	"rinha-backend-arthur/internal/models"
+	"rinha-backend-arthur/internal/queue"
+	"rinha-backend-arthur/internal/store"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestValidatePaymentPayloadAmount(t *testing.T) {
+	tests := []struct {
+		amount string
+		status int
+	}{
+		{"19.90", 0},
+		{"1.5e1", 0},
+		{"92233720368547758.07", 0},
+		{"92233720368547758.08", fasthttp.StatusUnprocessableEntity},
+		{"1e50", fasthttp.StatusUnprocessableEntity},
+		{"1e-50", fasthttp.StatusUnprocessableEntity},
+		{"0.001", fasthttp.StatusUnprocessableEntity},
+		{"0", fasthttp.StatusUnprocessableEntity},
+		{"-1", fasthttp.StatusUnprocessableEntity},
+		{`"10"`, fasthttp.StatusUnprocessableEntity},
+	}
+
+	for _, tt := range tests {
+		body := []byte(`{"correlationId":"4a7901b8-7d26-4d9d-aa19-4dc1c7cf60b3","amount":` + tt.amount + `}`)
+		if _, status, _ := validatePaymentPayload(body); status != tt.status {
+			t.Errorf("amount %s: status = %d, want %d", tt.amount, status, tt.status)
+		}
+	}
+}
+
+func TestValidatePaymentPayload(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		fields []string // fields reported as invalid, in order
+	}{
+		{"valid", `{"correlationId":"4a7901b8-7d26-4d9d-aa19-4dc1c7cf60b3","amount":19.90}`, 0, nil},
+		{"missing correlationId", `{"amount":19.90}`, fasthttp.StatusUnprocessableEntity, []string{"correlationId"}},
+		{"correlationId not a string", `{"correlationId":42,"amount":19.90}`, fasthttp.StatusUnprocessableEntity, []string{"correlationId"}},
+		{"correlationId not a UUID", `{"correlationId":"payment-1","amount":19.90}`, fasthttp.StatusUnprocessableEntity, []string{"correlationId"}},
+		{"nil correlationId", `{"correlationId":"00000000-0000-0000-0000-000000000000","amount":19.90}`, fasthttp.StatusUnprocessableEntity, []string{"correlationId"}},
+		{"missing amount", `{"correlationId":"4a7901b8-7d26-4d9d-aa19-4dc1c7cf60b3"}`, fasthttp.StatusUnprocessableEntity, []string{"amount"}},
+		{"unknown fields", `{"correlationId":"4a7901b8-7d26-4d9d-aa19-4dc1c7cf60b3","amount":19.90,"requestedAt":"now","currency":"BRL"}`, fasthttp.StatusUnprocessableEntity, []string{"currency", "requestedAt"}},
+		{"every field wrong", `{"correlationId":"","amount":-1,"extra":true}`, fasthttp.StatusUnprocessableEntity, []string{"extra", "correlationId", "amount"}},
+		{"malformed JSON", `{"correlationId":"4a7901b8-7d26-4d9d-aa19-4dc1c7cf60b3","amount":19.90`, fasthttp.StatusBadRequest, nil},
+		{"trailing JSON", `{"correlationId":"4a7901b8-7d26-4d9d-aa19-4dc1c7cf60b3","amount":19.90}{"amount":1}`, fasthttp.StatusBadRequest, nil},
+		{"not an object", `[{"correlationId":"4a7901b8-7d26-4d9d-aa19-4dc1c7cf60b3","amount":19.90}]`, fasthttp.StatusBadRequest, nil},
+		{"null", `null`, fasthttp.StatusBadRequest, nil},
+		{"empty body", ``, fasthttp.StatusBadRequest, nil},
+	}
+
+	for _, tt := range tests {
+		_, status, response := validatePaymentPayload([]byte(tt.body))
+		if status != tt.status {
+			t.Errorf("%s: status = %d, want %d", tt.name, status, tt.status)
+			continue
+		}
+		var fields []string
+		for _, field := range response.Fields {
+			fields = append(fields, field.Field)
+		}
+		if len(fields) != len(tt.fields) {
+			t.Errorf("%s: invalid fields = %v, want %v", tt.name, fields, tt.fields)
+			continue
+		}
+		for i := range fields {
+			if fields[i] != tt.fields[i] {
+				t.Errorf("%s: invalid fields = %v, want %v", tt.name, fields, tt.fields)
+				break
+			}
+		}
+	}
+}
+
+func TestHandlePaymentsStatus(t *testing.T) {
+	paymentQueue := queue.NewMemoryQueue(10)
+	h := &Handler{paymentProcessor: &distributor.PaymentProcessor{Store: store.NewMemoryStore(), Queue: paymentQueue}}
+
+	post := func(body string) *fasthttp.RequestCtx {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Request.Header.SetMethod(fasthttp.MethodPost)
+		ctx.Request.SetRequestURI("/payments")
+		ctx.Request.SetBodyString(body)
+		h.HandlePayments(ctx)
+		return ctx
+	}
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{"malformed JSON", `{"correlationId":`, fasthttp.StatusBadRequest},
+		{"invalid fields", `{"correlationId":"payment-1","amount":0}`, fasthttp.StatusUnprocessableEntity},
+		{"valid", `{"correlationId":"4a7901b8-7d26-4d9d-aa19-4dc1c7cf60b3","amount":19.90}`, fasthttp.StatusAccepted},
+		{"replay", `{"correlationId":"4a7901b8-7d26-4d9d-aa19-4dc1c7cf60b3","amount":19.90}`, fasthttp.StatusAccepted},
+	}
+	for _, tt := range tests {
+		ctx := post(tt.body)
+		if ctx.Response.StatusCode() != tt.status {
+			t.Fatalf("%s: status = %d, want %d: %s", tt.name, ctx.Response.StatusCode(), tt.status, ctx.Response.Body())
+		}
+		if tt.status >= fasthttp.StatusBadRequest {
+			var response models.ErrorResponse
+			if err := json.Unmarshal(ctx.Response.Body(), &response); err != nil || response.Error == "" {
+				t.Fatalf("%s: error body %s is not a JSON error: %v", tt.name, ctx.Response.Body(), err)
+			}
+			if tt.status == fasthttp.StatusUnprocessableEntity && len(response.Fields) != 2 {
+				t.Fatalf("%s: fields = %+v, want correlationId and amount", tt.name, response.Fields)
+			}
+		}
+	}
+
+	// Only the valid payment was enqueued, and only once
+	if depth, _ := paymentQueue.Depth(t.Context()); depth.Queued != 1 {
+		t.Fatalf("queued %d payments, want 1", depth.Queued)
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
@@ -16,10 +18,22 @@ import (
 func main() {
 	config := internal.NewConfig()
 
+	// ./main migrate moves unprefixed legacy keys, rewrites the stored records in the current version, backfills the summary buckets and exits
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := internal.RunMigration(*config); err != nil {
+			fmt.Printf("Migration failed: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// mux := http.NewServeMux()
 
+	ctx, cancelWorkers := context.WithCancel(context.Background())
+	defer cancelWorkers()
+
 	r := router.New()
-	internal.CreateRouter(r, *config)
+	shutdown := internal.CreateRouter(ctx, r, *config)
 
 	server := &fasthttp.Server{
 		Handler:      r.Handler,
@@ -41,12 +55,16 @@ func main() {
 	<-stop
 	// log.Println("Shutting down server...")
 
-	// Graceful shutdown
+	// Graceful shutdown, no new payments are accepted before the workers stop
 	// shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	// defer cancel()
 	if err := server.Shutdown(); err != nil {
 		// log.Fatalf("Server forced to shutdown: %v", err)
 	}
 
+	// Workers finish their claimed deliveries, then the store writes what they settled
+	cancelWorkers()
+	shutdown()
+
 	// log.Println("Server exited properly")
 }